@@ -0,0 +1,244 @@
+package model
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+type (
+	// PopulateCache 一个请求内的填充缓存 相同的 id 只查询一次
+	// 只缓存简单的 query 没有 Find Fields Sort Skip Limit Populate
+	// 相同 key 的 id 合并为一次查询 key 相同的 query 条件相同 使用第一个调用的 query
+	PopulateCache struct {
+		mutex   sync.Mutex
+		window  time.Duration
+		entries map[string]*populateCacheEntry
+		stats   PopulateCacheStats
+	}
+
+	PopulateCacheStats struct {
+		// 已经查询 或 正在查询的 id
+		Hits int
+		// 需要查询的 id
+		Misses int
+		// 查询次数
+		Batches int
+	}
+
+	// populateCacheEntry 一个 model 字段 类型 的 identity map
+	populateCacheEntry struct {
+		batches   map[interface{}]*populateBatch
+		pending   *populateBatch
+		values    []reflect.Value
+		valueIDs  [][]interface{}
+		documents map[interface{}][]int
+	}
+
+	// populateBatch window 内合并的一次查询
+	populateBatch struct {
+		ids  []interface{}
+		done chan struct{}
+		err  error
+	}
+)
+
+// 默认合并查询的等待时间
+var PopulateCacheWindow = time.Millisecond
+
+var populateCacheContextKey = &contextKey{"populateCache"}
+
+// WithPopulateCache 开启请求内的填充缓存 window 为 0 使用 PopulateCacheWindow
+func WithPopulateCache(ctx context.Context, window time.Duration) (context.Context, *PopulateCache) {
+	if window <= 0 {
+		window = PopulateCacheWindow
+	}
+	cache := &PopulateCache{window: window, entries: map[string]*populateCacheEntry{}}
+	return context.WithValue(ctx, populateCacheContextKey, cache), cache
+}
+
+func PopulateCacheFrom(ctx context.Context) (cache *PopulateCache, ok bool) {
+	cache, ok = ctx.Value(populateCacheContextKey).(*PopulateCache)
+	return
+}
+
+func (cache *PopulateCache) Stats() PopulateCacheStats {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	return cache.stats
+}
+
+// populateCacheable 简单的 query 结果只和 id 有关
+func populateCacheable(query *Query) bool {
+	return len(query.Query) == 0 && query.Populate == nil && len(query.Options.Fields) == 0 && len(query.Options.Sort) == 0 && query.Options.Skip == 0 && query.Options.Limit == 0
+}
+
+// populateCacheKey 租户的 数据库 集合 和 Map (Trash Unscoped DefaultScopes) 相同的 结果相同
+func populateCacheKey(findPath []string, sliceTyp reflect.Type, query *Query) (key string, err error) {
+	var maps bson.M
+	if maps, err = query.Map(); err != nil {
+		return
+	}
+	database, collection := "", query.Options.Name
+	if model, ok := query.Model.(*Model); ok {
+		if database, collection, err = model.tenantNames(query.Context); err != nil {
+			return
+		}
+	}
+	key = fmt.Sprintf("%s.%s:%s:%s:%v", database, collection, strings.Join(findPath, "."), sliceTyp.String(), maps)
+	return
+}
+
+// populateFetch 有缓存的使用缓存 否则 reflectFetch
+func populateFetch(ctx context.Context, findPath []string, findIDs []interface{}, sliceTyp reflect.Type, query *Query) (sliceVal reflect.Value, fetchIDs [][]interface{}, err error) {
+	cache, ok := PopulateCacheFrom(ctx)
+	if !ok || !populateCacheable(query) {
+		return reflectFetch(findPath, findIDs, sliceTyp, query)
+	}
+	var key string
+	if key, err = populateCacheKey(findPath, sliceTyp, query); err != nil {
+		return
+	}
+	return cache.fetch(ctx, key, findPath, findIDs, sliceTyp, query)
+}
+
+func (cache *PopulateCache) fetch(ctx context.Context, key string, findPath []string, findIDs []interface{}, sliceTyp reflect.Type, query *Query) (sliceVal reflect.Value, fetchIDs [][]interface{}, err error) {
+	cache.mutex.Lock()
+	entry, ok := cache.entries[key]
+	if !ok {
+		entry = &populateCacheEntry{batches: map[interface{}]*populateBatch{}, documents: map[interface{}][]int{}}
+		cache.entries[key] = entry
+	}
+	waits := map[*populateBatch]bool{}
+	for _, id := range findIDs {
+		if batch, ok := entry.batches[id]; ok {
+			cache.stats.Hits++
+			waits[batch] = true
+			continue
+		}
+		cache.stats.Misses++
+		if entry.pending == nil {
+			entry.pending = &populateBatch{done: make(chan struct{})}
+			go cache.run(entry, entry.pending, findPath, sliceTyp, query)
+		}
+		entry.pending.ids = append(entry.pending.ids, id)
+		entry.batches[id] = entry.pending
+		waits[entry.pending] = true
+	}
+	cache.mutex.Unlock()
+
+	for batch := range waits {
+		select {
+		case <-batch.done:
+		case <-ctx.Done():
+			err = ctx.Err()
+			return
+		}
+		if batch.err != nil {
+			err = batch.err
+			return
+		}
+	}
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	exists := map[int]bool{}
+	var indexs []int
+	for _, id := range findIDs {
+		for _, i := range entry.documents[id] {
+			if !exists[i] {
+				exists[i] = true
+				indexs = append(indexs, i)
+			}
+		}
+	}
+	sort.Ints(indexs)
+	// 缓存的 document 不返回 每次复制 调用的深度填充不会修改缓存
+	sliceVal = reflect.MakeSlice(reflect.SliceOf(sliceTyp), 0, len(indexs))
+	for _, i := range indexs {
+		var value reflect.Value
+		if value, err = populateCacheCopy(entry.values[i]); err != nil {
+			return
+		}
+		sliceVal = reflect.Append(sliceVal, value)
+		fetchIDs = append(fetchIDs, entry.valueIDs[i])
+	}
+	return
+}
+
+// populateCacheCopy 结构体用 documentClone 其他的 bson 序列化复制
+func populateCacheCopy(value reflect.Value) (clone reflect.Value, err error) {
+	typ := value.Type()
+	if typ.Kind() == reflect.Ptr && value.IsNil() {
+		clone = value
+		return
+	}
+	if typ.Kind() == reflect.Struct || (typ.Kind() == reflect.Ptr && typ.Elem().Kind() == reflect.Struct) {
+		if clone, err = documentClone(value); err != nil {
+			return
+		}
+		if typ.Kind() == reflect.Struct {
+			clone = clone.Elem()
+		}
+		return
+	}
+	var data []byte
+	if data, err = bson.Marshal(value.Interface()); err != nil {
+		return
+	}
+	clone = reflect.New(typ)
+	if err = bson.Unmarshal(data, clone.Interface()); err != nil {
+		return
+	}
+	clone = clone.Elem()
+	return
+}
+
+// run 等待 window 后查询 合并期间加入的 id
+func (cache *PopulateCache) run(entry *populateCacheEntry, batch *populateBatch, findPath []string, sliceTyp reflect.Type, query *Query) {
+	time.Sleep(cache.window)
+
+	cache.mutex.Lock()
+	entry.pending = nil
+	ids := batch.ids
+	cache.stats.Batches++
+	cache.mutex.Unlock()
+
+	sliceVal, fetchIDs, err := reflectFetch(findPath, ids, sliceTyp, query)
+
+	cache.mutex.Lock()
+	if err != nil {
+		// 失败的 id 下次重新查询
+		for _, id := range ids {
+			if entry.batches[id] == batch {
+				delete(entry.batches, id)
+			}
+		}
+	} else {
+		// 只记录本次查询的 id 其他 id 单独查询
+		inBatch := make(map[interface{}]bool, len(ids))
+		for _, id := range ids {
+			inBatch[id] = true
+		}
+		for i := 0; i < sliceVal.Len(); i++ {
+			index := len(entry.values)
+			entry.values = append(entry.values, sliceVal.Index(i))
+			entry.valueIDs = append(entry.valueIDs, fetchIDs[i])
+			for _, id := range fetchIDs[i] {
+				if inBatch[id] {
+					entry.documents[id] = append(entry.documents[id], index)
+				}
+			}
+		}
+	}
+	cache.mutex.Unlock()
+
+	batch.err = err
+	close(batch.done)
+}
@@ -0,0 +1,82 @@
+package model
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+type cacheTestDocument struct {
+	DocumentBase `json:"-" bson:"-"`
+	ID           int                  `bson:"_id"`
+	Tags         []string             `bson:"tags"`
+	Deleted      bool                 `bson:"deleted"`
+	Owner        *cacheTestDocument   `bson:"-"`
+	Children     []*cacheTestDocument `bson:"-"`
+}
+
+func TestPopulateCacheKey(t *testing.T) {
+	model := &Model{Name: "app.users", Document: &cacheTestDocument{}, Tenant: TenantPrefix, DefaultScopes: []ModelDefaultScope{
+		func(ctx context.Context) (map[string]interface{}, error) {
+			return map[string]interface{}{"org": ctx.Value(tenantContextKey)}, nil
+		},
+	}}
+	typ := reflect.TypeOf(&cacheTestDocument{})
+	key := func(query *Query) string {
+		key, err := populateCacheKey([]string{"ID"}, typ, query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+	a := WithTenant(context.Background(), "a")
+	b := WithTenant(context.Background(), "b")
+	keys := map[string]string{
+		"a":          key(model.Query(a)),
+		"b":          key(model.Query(b)),
+		"unscoped":   key(model.Query(a).Unscoped()),
+		"trash":      key(model.Query(a).Trash(1)),
+		"collection": key(&Query{Context: a, Model: model, Options: QueryOptions{Name: "app.users"}}),
+	}
+	if keys["a"] != keys["collection"] {
+		t.Errorf("same query keys differ: %s %s", keys["a"], keys["collection"])
+	}
+	delete(keys, "collection")
+	seen := map[string]string{}
+	for name, key := range keys {
+		if other, ok := seen[key]; ok {
+			t.Errorf("%s and %s share key %s", name, other, key)
+		}
+		seen[key] = name
+	}
+
+	// 没有租户的 不缓存 返回错误
+	if _, err := populateCacheKey([]string{"ID"}, typ, model.Query(context.Background())); err == nil {
+		t.Errorf("no tenant without error")
+	}
+}
+
+func TestPopulateCacheCopy(t *testing.T) {
+	value := &cacheTestDocument{ID: 1, Tags: []string{"a"}}
+	clone, err := populateCacheCopy(reflect.ValueOf(value))
+	if err != nil {
+		t.Fatal(err)
+	}
+	copied := clone.Interface().(*cacheTestDocument)
+	if copied == value || copied.ID != 1 || !reflect.DeepEqual(copied.Tags, value.Tags) {
+		t.Fatalf("copy = %#v", copied)
+	}
+	copied.Tags[0] = "b"
+	copied.Owner = &cacheTestDocument{ID: 2}
+	if value.Tags[0] != "a" || value.Owner != nil {
+		t.Errorf("cached value modified %#v", value)
+	}
+
+	clone, err = populateCacheCopy(reflect.ValueOf(map[string]interface{}{"_id": 1, "tags": []interface{}{"a"}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := clone.Interface().(map[string]interface{}); m["_id"] != 1 {
+		t.Errorf("map copy = %#v", m)
+	}
+}
@@ -0,0 +1,231 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+type (
+	ModelCollection struct {
+		// 固定集合
+		Capped   bool
+		MaxBytes int
+		MaxDocs  int
+		// 默认排序规则
+		Collation *mgo.Collation
+		// 和 Schema 的 $jsonSchema 合并
+		Validator     bson.M
+		StorageEngine interface{}
+		// 视图
+		ViewOn   string
+		Pipeline []bson.M
+		// 时间序列
+		TimeSeries  *ModelTimeSeries
+		ExpireAfter time.Duration
+	}
+
+	ModelTimeSeries struct {
+		TimeField   string `bson:"timeField"`
+		MetaField   string `bson:"metaField,omitempty"`
+		Granularity string `bson:"granularity,omitempty"`
+	}
+
+	collectionOptions struct {
+		Capped             bool             `bson:"capped"`
+		Size               float64          `bson:"size"`
+		Max                float64          `bson:"max"`
+		Collation          *mgo.Collation   `bson:"collation"`
+		Validator          bson.M           `bson:"validator"`
+		ValidationLevel    string           `bson:"validationLevel"`
+		ValidationAction   string           `bson:"validationAction"`
+		ViewOn             string           `bson:"viewOn"`
+		Pipeline           []bson.M         `bson:"pipeline"`
+		TimeSeries         *ModelTimeSeries `bson:"timeseries"`
+		ExpireAfterSeconds float64          `bson:"expireAfterSeconds"`
+	}
+)
+
+// validator Collection.Validator 和 $jsonSchema 合并
+func (model *Model) validator() (validator bson.M) {
+	if model.Collection.Validator == nil && !model.Schema {
+		return
+	}
+	validator = bson.M{}
+	for key, val := range model.Collection.Validator {
+		validator[key] = val
+	}
+	if model.Schema {
+		validator["$jsonSchema"] = model.JSONSchema()
+	}
+	return
+}
+
+func (model *Model) createCommand(name string) (command bson.D) {
+	command = bson.D{{Name: "create", Value: name}}
+	options := model.Collection
+	if options.Capped {
+		command = append(command, bson.DocElem{Name: "capped", Value: true}, bson.DocElem{Name: "size", Value: options.MaxBytes})
+		if options.MaxDocs > 0 {
+			command = append(command, bson.DocElem{Name: "max", Value: options.MaxDocs})
+		}
+	}
+	if options.Collation != nil {
+		command = append(command, bson.DocElem{Name: "collation", Value: options.Collation})
+	}
+	if validator := model.validator(); validator != nil {
+		command = append(command, bson.DocElem{Name: "validator", Value: validator})
+	}
+	if model.ValidationLevel != "" {
+		command = append(command, bson.DocElem{Name: "validationLevel", Value: model.ValidationLevel})
+	}
+	if model.ValidationAction != "" {
+		command = append(command, bson.DocElem{Name: "validationAction", Value: model.ValidationAction})
+	}
+	if options.StorageEngine != nil {
+		command = append(command, bson.DocElem{Name: "storageEngine", Value: options.StorageEngine})
+	}
+	if options.ViewOn != "" {
+		command = append(command, bson.DocElem{Name: "viewOn", Value: options.ViewOn}, bson.DocElem{Name: "pipeline", Value: options.pipeline()})
+	}
+	if options.TimeSeries != nil {
+		command = append(command, bson.DocElem{Name: "timeseries", Value: options.TimeSeries})
+	}
+	if options.ExpireAfter != 0 {
+		command = append(command, bson.DocElem{Name: "expireAfterSeconds", Value: int64(options.ExpireAfter / time.Second)})
+	}
+	return
+}
+
+func (options ModelCollection) pipeline() []bson.M {
+	if options.Pipeline == nil {
+		return []bson.M{}
+	}
+	return options.Pipeline
+}
+
+// validate 选项组合 服务器不支持的 返回错误
+func (options ModelCollection) validate() (err error) {
+	if options.ExpireAfter != 0 && options.TimeSeries == nil {
+		err = errors.New("Collection ExpireAfter requires TimeSeries")
+		return
+	}
+	if options.Capped && options.MaxBytes <= 0 {
+		err = errors.New("Collection Capped requires MaxBytes")
+		return
+	}
+	return
+}
+
+// collectionInfo 服务器的集合选项 集合不存在 exists 为 false
+func (model *Model) collectionInfo(ctx context.Context) (db *mgo.Database, name string, options collectionOptions, exists bool, err error) {
+	var database string
+	if database, name, err = model.tenantNames(ctx); err != nil {
+		return
+	}
+	var session *mgo.Session
+	if session, err = model.session(ctx); err != nil {
+		return
+	}
+	db = session.DB(database)
+
+	result := struct {
+		Cursor struct {
+			FirstBatch []struct {
+				Options collectionOptions `bson:"options"`
+			} `bson:"firstBatch"`
+		} `bson:"cursor"`
+	}{}
+	if err = db.Run(bson.D{{Name: "listCollections", Value: 1}, {Name: "filter", Value: bson.M{"name": name}}}, &result); err != nil {
+		return
+	}
+	if len(result.Cursor.FirstBatch) != 0 {
+		options = result.Cursor.FirstBatch[0].Options
+		exists = true
+	}
+	return
+}
+
+// collectionDrift 不能修改的选项 和服务器不同的
+func collectionDrift(collection ModelCollection, options collectionOptions) (drift []string) {
+	// size 服务器会向上取整到 256
+	if options.Capped != collection.Capped || (collection.Capped && (int(options.Size) < collection.MaxBytes || int(options.Size) >= collection.MaxBytes+256 || int(options.Max) != collection.MaxDocs)) {
+		drift = append(drift, "drift.capped")
+	}
+	if !reflect.DeepEqual(collationNormalize(options.Collation), collationNormalize(collection.Collation)) {
+		drift = append(drift, "drift.collation")
+	}
+	if (options.TimeSeries == nil) != (collection.TimeSeries == nil) || (collection.TimeSeries != nil && (options.TimeSeries.TimeField != collection.TimeSeries.TimeField || options.TimeSeries.MetaField != collection.TimeSeries.MetaField)) {
+		drift = append(drift, "drift.timeseries")
+	}
+	if (options.ViewOn == "") != (collection.ViewOn == "") {
+		drift = append(drift, "drift.view")
+	}
+	return
+}
+
+// updateCollection 对比服务器的集合选项 能修改的 collMod 不能修改的 返回 drift.*  validator 由 updateSchema 修改
+func (model *Model) updateCollection(ctx context.Context) (updated []string, err error) {
+	if err = model.Collection.validate(); err != nil {
+		return
+	}
+	var db *mgo.Database
+	var name string
+	var options collectionOptions
+	var exists bool
+	if db, name, options, exists, err = model.collectionInfo(ctx); err != nil || !exists {
+		return
+	}
+	collection := model.Collection
+	updated = collectionDrift(collection, options)
+
+	command := bson.D{{Name: "collMod", Value: name}}
+
+	// 视图
+	if collection.ViewOn != "" && options.ViewOn != "" {
+		var pipeline []bson.M
+		var data []byte
+		if data, err = bson.Marshal(bson.M{"pipeline": collection.pipeline()}); err != nil {
+			return
+		}
+		value := struct {
+			Pipeline []bson.M `bson:"pipeline"`
+		}{}
+		if err = bson.Unmarshal(data, &value); err != nil {
+			return
+		}
+		pipeline = value.Pipeline
+		if options.ViewOn != collection.ViewOn || !reflect.DeepEqual(options.Pipeline, pipeline) {
+			command = append(command, bson.DocElem{Name: "viewOn", Value: collection.ViewOn}, bson.DocElem{Name: "pipeline", Value: collection.pipeline()})
+			updated = append(updated, "set.view")
+		}
+	}
+
+	// 时间序列
+	if collection.TimeSeries != nil && options.TimeSeries != nil && collection.TimeSeries.Granularity != "" && collection.TimeSeries.Granularity != options.TimeSeries.Granularity {
+		command = append(command, bson.DocElem{Name: "timeseries", Value: bson.M{"granularity": collection.TimeSeries.Granularity}})
+		updated = append(updated, "set.granularity")
+	}
+	if expireAfterSeconds := int64(collection.ExpireAfter / time.Second); expireAfterSeconds != int64(options.ExpireAfterSeconds) {
+		if expireAfterSeconds == 0 {
+			command = append(command, bson.DocElem{Name: "expireAfterSeconds", Value: "off"})
+		} else {
+			command = append(command, bson.DocElem{Name: "expireAfterSeconds", Value: expireAfterSeconds})
+		}
+		updated = append(updated, "set.expireAfterSeconds")
+	}
+
+	if len(command) == 1 {
+		return
+	}
+	if err = db.Run(command, nil); err != nil {
+		err = fmt.Errorf("collMod %s: %s", name, err.Error())
+		return
+	}
+	return
+}
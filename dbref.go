@@ -0,0 +1,233 @@
+package model
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+type (
+	// dbRefGroup 同一个 数据库 集合 的 id
+	dbRefGroup struct {
+		database   string
+		collection string
+		ids        []interface{}
+	}
+)
+
+var dbRefType = reflect.TypeOf(mgo.DBRef{})
+
+// isDBRef 字段 (指针 切片 map) 是 mgo.DBRef
+func isDBRef(typ reflect.Type) bool {
+	for typ.Kind() == reflect.Ptr || typ.Kind() == reflect.Slice || typ.Kind() == reflect.Map {
+		typ = typ.Elem()
+	}
+	return typ == dbRefType
+}
+
+func dbRefKey(database string, collection string, id interface{}) string {
+	return fmt.Sprintf("%s.%s:%v", database, collection, id)
+}
+
+func dbRefVisitKey(key string) string {
+	return "dbref:" + key
+}
+
+// reflectDBRef 按 数据库 集合 分组查询 _id 用 query.Targets 或注册的 model 都没有的直接查询集合
+// query.Targets 的 key 是 "数据库.集合" 或 "集合"
+func reflectDBRef(ctx context.Context, path string, findValues []reflectValue, query *Query, sliceTyp reflect.Type) (err error) {
+	// 分组 id 转换为 dbRefKey
+	state := populateStateFrom(ctx)
+	var keys []string
+	groups := map[string]*dbRefGroup{}
+	fetched := map[interface{}]bool{}
+	refValues := make([]reflectValue, 0, len(findValues))
+	for _, findValue := range findValues {
+		// 已经填充的 不再查询
+		value := findValue.value
+		if value.Kind() == reflect.Map {
+			value = value.MapIndex(findValue.key)
+		}
+		if !reflectValueEmpty(value) {
+			continue
+		}
+		refValue := findValue
+		refValue.ids = nil
+		for _, id := range findValue.ids {
+			var ref mgo.DBRef
+			switch id := id.(type) {
+			case mgo.DBRef:
+				ref = id
+			case *mgo.DBRef:
+				ref = *id
+			}
+			if ref.Collection == "" || ref.Id == nil {
+				continue
+			}
+			// 循环引用 这个 document 的上级中已经有的 不再填充
+			key := dbRefKey(ref.Database, ref.Collection, ref.Id)
+			if state.path(findValue.document)[dbRefVisitKey(key)] {
+				continue
+			}
+			groupKey := ref.Database + "." + ref.Collection
+			group, ok := groups[groupKey]
+			if !ok {
+				group = &dbRefGroup{database: ref.Database, collection: ref.Collection}
+				groups[groupKey] = group
+				keys = append(keys, groupKey)
+			}
+			if !fetched[key] {
+				fetched[key] = true
+				group.ids = append(group.ids, ref.Id)
+			}
+			refValue.ids = append(refValue.ids, key)
+		}
+		refValues = append(refValues, refValue)
+	}
+	sort.Strings(keys)
+
+	fetchValue := reflect.MakeSlice(reflect.SliceOf(sliceTyp), 0, 0)
+	var fetchIDs [][]interface{}
+	for _, groupKey := range keys {
+		if err = ctx.Err(); err != nil {
+			return
+		}
+		group := groups[groupKey]
+		var groupValue reflect.Value
+		var groupIDs [][]interface{}
+		if groupValue, groupIDs, err = dbRefFetch(ctx, group, query, sliceTyp); err != nil {
+			return
+		}
+		for i := 0; i < groupValue.Len(); i++ {
+			value := groupValue.Index(i)
+			if sliceTyp.Kind() != reflect.Interface && value.Type() != sliceTyp {
+				err = fmt.Errorf("collection (%s) document %s not %s", groupKey, value.Type().String(), sliceTyp.String())
+				return
+			}
+			fetchValue = reflect.Append(fetchValue, value)
+			var ids []interface{}
+			for _, id := range groupIDs[i] {
+				ids = append(ids, dbRefKey(group.database, group.collection, id))
+			}
+			fetchIDs = append(fetchIDs, ids)
+		}
+	}
+
+	// 深度填充 只有一种类型的 先填充 再赋值给父级
+	if query.Populate != nil && sliceTyp.Kind() != reflect.Interface && fetchValue.Len() != 0 {
+		slicePtr := reflect.New(fetchValue.Type())
+		slicePtr.Elem().Set(fetchValue)
+		paths := state.childPaths(refValues, fetchIDs, func(id interface{}) string {
+			return dbRefVisitKey(id.(string))
+		})
+		if err = query.Populate.AllContext(context.WithValue(ctx, populateStateContextKey, state.child(paths)), slicePtr.Interface()); err != nil {
+			return
+		}
+		fetchValue = slicePtr.Elem()
+	}
+
+	err = populateMissing(ctx, path, query, reflectAssign(refValues, fetchValue, fetchIDs, query, fetched))
+	return
+}
+
+// dbRefFetch 查询一组 id 返回 document 和 每个 document 的 _id
+func dbRefFetch(ctx context.Context, group *dbRefGroup, query *Query, sliceTyp reflect.Type) (sliceVal reflect.Value, fetchIDs [][]interface{}, err error) {
+	if target, ok := dbRefTarget(ctx, group, query, DefaultRegistry); ok {
+		typ := sliceTyp
+		if typ.Kind() == reflect.Interface {
+			model, ok := target.Model.(*Model)
+			if !ok || model.Document == nil {
+				err = fmt.Errorf("collection (%s.%s) model document not found", group.database, group.collection)
+				return
+			}
+			typ = reflect.TypeOf(model.Document)
+		}
+		return reflectFetch([]string{"ID"}, group.ids, typ, target)
+	}
+
+	// 没有 model 的 直接查询集合 interface 的解码为 bson.M
+	var collection *mgo.Collection
+	var release func()
+	if collection, release, err = dbRefCollection(ctx, group, query); err != nil {
+		return
+	}
+	defer release()
+
+	var raws []bson.Raw
+	if err = collection.Find(bson.M{"_id": bson.M{"$in": group.ids}}).All(&raws); err != nil {
+		return
+	}
+	typ := sliceTyp
+	if typ.Kind() == reflect.Interface {
+		typ = reflect.TypeOf(bson.M{})
+	}
+	sliceVal = reflect.MakeSlice(reflect.SliceOf(typ), 0, len(raws))
+	for _, raw := range raws {
+		var document struct {
+			ID interface{} `bson:"_id"`
+		}
+		if err = raw.Unmarshal(&document); err != nil {
+			return
+		}
+		value := reflect.New(typ)
+		if err = raw.Unmarshal(value.Interface()); err != nil {
+			return
+		}
+		sliceVal = reflect.Append(sliceVal, value.Elem())
+		fetchIDs = append(fetchIDs, []interface{}{document.ID})
+	}
+	return
+}
+
+// dbRefCollection 没有 model 的集合 用 context (租户请求) 的 session 没有的用 query.Model 的 session
+// DBRef 没有数据库的 用 session 的默认数据库
+func dbRefCollection(ctx context.Context, group *dbRefGroup, query *Query) (collection *mgo.Collection, release func(), err error) {
+	var session *mgo.Session
+	if model, ok := query.Model.(*Model); ok && model != nil {
+		if session, err = model.session(ctx); err != nil {
+			return
+		}
+	} else if session, ok = SessionFrom(ctx); !ok {
+		err = ErrNoSession
+		return
+	}
+	session = session.Clone()
+	SessionOptionsFrom(ctx).apply(session)
+	collection = session.DB(group.database).C(group.collection)
+	release = session.Close
+	return
+}
+
+// dbRefTarget query.Targets 或 registry 中 租户的 数据库 集合 相同的 model
+// DBRef 没有数据库的 只比较集合 model 没有数据库的 只能用 query.Targets
+func dbRefTarget(ctx context.Context, group *dbRefGroup, query *Query, registry *Registry) (target *Query, ok bool) {
+	name := group.collection
+	if group.database != "" {
+		name = group.database + "." + group.collection
+	}
+	if target = query.Targets[name]; target != nil {
+		ok = true
+		return
+	}
+	if target = query.Targets[group.collection]; target != nil {
+		ok = true
+		return
+	}
+	// context 中没有租户的 model 不会是目标
+	for _, model := range registry.Models() {
+		database, collection, tenantErr := model.tenantNames(ctx)
+		if tenantErr != nil {
+			continue
+		}
+		if collection == group.collection && (group.database == "" || database == group.database) {
+			target = model.Query(ctx)
+			ok = true
+			return
+		}
+	}
+	return
+}
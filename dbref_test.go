@@ -0,0 +1,65 @@
+package model
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestDBRefTarget(t *testing.T) {
+	users := &Model{Name: "app.users"}
+	posts := &Model{Name: "posts", Tenant: TenantDatabase}
+	logs := &Model{Name: "logs"}
+	registry := &Registry{}
+	registry.Register(users, posts)
+	ctx := WithTenant(context.Background(), "t1")
+
+	tests := []struct {
+		name    string
+		ctx     context.Context
+		group   dbRefGroup
+		targets map[string]*Query
+		model   *Model
+	}{
+		{name: "database collection", ctx: ctx, group: dbRefGroup{database: "app", collection: "users"}, model: users},
+		{name: "collection", ctx: ctx, group: dbRefGroup{collection: "users"}, model: users},
+		{name: "other database", ctx: ctx, group: dbRefGroup{database: "other", collection: "users"}},
+		{name: "tenant", ctx: ctx, group: dbRefGroup{database: "t1", collection: "posts"}, model: posts},
+		{name: "other tenant", ctx: ctx, group: dbRefGroup{database: "t2", collection: "posts"}},
+		{name: "no tenant", ctx: context.Background(), group: dbRefGroup{database: "app", collection: "users"}, model: users},
+		{name: "no tenant posts", ctx: context.Background(), group: dbRefGroup{collection: "posts"}},
+		{name: "target", ctx: ctx, group: dbRefGroup{database: "app", collection: "logs"}, targets: map[string]*Query{"logs": logs.Query(ctx)}, model: logs},
+		{name: "target name", ctx: ctx, group: dbRefGroup{database: "app", collection: "users"}, targets: map[string]*Query{"app.users": logs.Query(ctx)}, model: logs},
+		{name: "not registered", ctx: ctx, group: dbRefGroup{database: "app", collection: "logs"}},
+	}
+	for _, test := range tests {
+		target, ok := dbRefTarget(test.ctx, &test.group, &Query{Targets: test.targets}, registry)
+		if test.model == nil {
+			if ok {
+				t.Errorf("%s: target = %v", test.name, target.Model)
+			}
+			continue
+		}
+		if !ok {
+			t.Errorf("%s: target not found", test.name)
+			continue
+		}
+		if target.Model != test.model {
+			t.Errorf("%s: model = %v", test.name, target.Model)
+		}
+	}
+}
+
+func TestDBRefCollection(t *testing.T) {
+	// 没有 model 的集合 直接查询 需要 context 或 query.Model 的 session
+	group := &dbRefGroup{database: "app", collection: "dbRefTestUnknown", ids: []interface{}{1}}
+	if _, _, err := dbRefCollection(context.Background(), group, &Query{}); err != ErrNoSession {
+		t.Errorf("collection err = %v", err)
+	}
+	if _, _, err := dbRefCollection(context.Background(), group, &Query{Model: &Model{Name: "app.users"}}); err != ErrNoSession {
+		t.Errorf("model collection err = %v", err)
+	}
+	if _, _, err := dbRefFetch(context.Background(), group, &Query{}, reflect.TypeOf((*interface{})(nil)).Elem()); err != ErrNoSession {
+		t.Errorf("fetch err = %v", err)
+	}
+}
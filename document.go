@@ -10,6 +10,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/globalsign/mgo"
 	"github.com/globalsign/mgo/bson"
 )
 
@@ -22,15 +23,32 @@ type (
 		JSONOmitempty bool
 		BSON          string
 		BSONOmitempty bool
-		Populate      struct {
-			Index int
-			Name  string
-			Find  string
+		// populate:"<Name>,<Find>,<flags...>"
+		// Name 本结构体储存 id 的字段 默认 ID
+		// Find 目标结构体的字段路径 默认 ID
+		// reverse 反向 目标的 Find 字段等于本结构体的 Name (一对多)
+		// count 填充数量 到 int 字段 exists 填充是否存在 到 bool 字段 需要传入目标 Query
+		// type=<Field> 本结构体的 string 字段 选择目标 model (多态)
+		// Name 字段是 mgo.DBRef 的 按 数据库 集合 查询 _id
+		Populate struct {
+			Index              int
+			Name               string
+			Find               string
+			Reverse            bool
+			Count              bool
+			Exists             bool
+			Discriminator      string
+			DiscriminatorIndex int
+			DBRef              bool
 		}
 		Children DocumentStruct
+		Type     reflect.Type
+		Validate []ValidateRule
+		Indexs   []DocumentStructIndex
 	}
 
 	DocumentPopulate struct {
+		Context  context.Context
 		Document DocumentInterface
 		Populate Populate
 	}
@@ -46,6 +64,8 @@ type (
 		Model   ModelInterface    `json:"-" bson:"-"`
 		Ref     DocumentInterface `json:"-" bson:"-"`
 		Old     DocumentInterface `json:"-" bson:"-"`
+		// 快照 最后一个是最后一次保存的
+		Versions []DocumentInterface `json:"-" bson:"-"`
 	}
 
 	DocumentInterface interface {
@@ -54,11 +74,15 @@ type (
 		IsModified(name string) (modified bool)
 
 		// 重置到版本号
-		// Reset(i int) (err error)
+		Reset(i int) (err error)
+		// 从历史记录恢复并保存
+		Revert(version int) (err error)
 		Save() (err error)
 		Insert() (err error)
 		Update() (err error)
 		UpdateAndFind(update interface{}, isNew bool) (err error)
+		// 不验证 update 文档
+		UpdateAndFindSkipValidate(update interface{}, isNew bool) (err error)
 		Delete() (err error)
 		Restore() (err error)
 		Validate() (err error)
@@ -69,6 +93,9 @@ type (
 
 var documentStructCacheVal = &documentStructCache{}
 
+// 内存中保留的快照数量
+var DocumentVersions = 10
+
 func (document *DocumentBase) New(ctx context.Context, model ModelInterface, doc DocumentInterface, isNew bool) DocumentInterface {
 	document.Context = ctx
 	document.Model = model
@@ -115,22 +142,74 @@ func (document *DocumentBase) ResetDocumentOld() {
 	documentOldv := reflect.Indirect(reflect.ValueOf(document.Ref))
 	documentOldvPtr := reflect.New(documentOldv.Type())
 	documentOldvPtr.Elem().Set(documentOldv)
+	documentBaseReset(documentOldvPtr)
 	document.Old = documentOldvPtr.Interface().(DocumentInterface)
+
+	// 快照 深复制 之后修改 Ref 不影响
+	versionvPtr, err := documentClone(documentOldvPtr)
+	if err != nil {
+		versionvPtr = documentOldvPtr
+	}
+	documentBaseReset(versionvPtr)
+	document.Versions = append(document.Versions, versionvPtr.Interface().(DocumentInterface))
+	if len(document.Versions) > DocumentVersions {
+		document.Versions = document.Versions[len(document.Versions)-DocumentVersions:]
+	}
 	return
 }
 
-func (document *DocumentBase) Validate() (err error) {
-	if Validator != nil {
-		if err = Validator.ValidateDocument(document.Ref); err != nil {
-			return
+// documentBaseReset 快照 不再嵌套 Old Ref 快照
+func documentBaseReset(documentPtr reflect.Value) {
+	if base := documentPtr.Elem().FieldByName("DocumentBase"); base.IsValid() && base.Kind() == reflect.Struct {
+		for _, name := range []string{"Ref", "Old", "Versions"} {
+			base.FieldByName(name).Set(reflect.Zero(base.FieldByName(name).Type()))
 		}
 	}
-	if err = document.Model.DoEvent("validate", document.Ref); err != nil {
+}
+
+// Reset 重置到快照 0 是最后一次保存的 1 是上一次 只修改内存中的 document
+func (document *DocumentBase) Reset(i int) (err error) {
+	if document.Ref == nil {
+		err = errors.New("Document=nil")
+		return
+	}
+	if i < 0 || i >= len(document.Versions) {
+		err = fmt.Errorf("Document version (%d) not exists", i)
 		return
 	}
+	err = documentCopy(reflect.ValueOf(document.Ref), reflect.ValueOf(document.Versions[len(document.Versions)-1-i]))
 	return
 }
 
+// Revert 恢复到历史记录的版本号 并保存
+func (document *DocumentBase) Revert(version int) (err error) {
+	if document.IsNew {
+		err = errors.New("Document isNew=true")
+		return
+	}
+	if document.Ref == nil {
+		err = errors.New("Document=nil")
+		return
+	}
+	id := reflect.Indirect(reflect.ValueOf(document.Old)).FieldByName("ID").Interface()
+
+	documentv := reflect.New(reflect.Indirect(reflect.ValueOf(document.Ref)).Type())
+	if err = document.Model.HistoryVersion(document.Context, id, version, documentv.Interface()); err != nil {
+		if err == mgo.ErrNotFound {
+			err = fmt.Errorf("Document version (%d) not exists", version)
+		}
+		return
+	}
+	if err = documentCopy(reflect.ValueOf(document.Ref), documentv); err != nil {
+		return
+	}
+	return document.Update()
+}
+
+func (document *DocumentBase) Validate() (err error) {
+	return document.Model.Validate(document.Ref)
+}
+
 func (document *DocumentBase) Insert() (err error) {
 
 	if !document.IsNew {
@@ -176,11 +255,21 @@ func (document *DocumentBase) Insert() (err error) {
 	}
 
 	// 插入
-	if err = document.Model.DB(document.Context).Insert(document.Ref); err != nil {
+	var collection *mgo.Collection
+	var release func()
+	if collection, release, err = document.Model.DBContext(document.Context); err != nil {
+		return
+	}
+	defer release()
+	if err = collection.Insert(document.Ref); err != nil {
 		return
 	}
 	document.ResetDocumentOld()
 	document.IsNew = false
+
+	if err = document.Model.DoHistory(document.Context, "insert", field.Interface(), nil); err != nil {
+		return
+	}
 	return
 }
 
@@ -262,11 +351,24 @@ func (document *DocumentBase) Update() (err error) {
 	if err = document.Model.Query(document.Context).ID(id).Update(update); err != nil {
 		return
 	}
+	old := document.Old
 	document.ResetDocumentOld()
+
+	if err = document.Model.DoHistory(document.Context, "update", id, old); err != nil {
+		return
+	}
 	return
 }
 
 func (document *DocumentBase) UpdateAndFind(update interface{}, isNew bool) (err error) {
+	return document.updateAndFind(update, isNew, false)
+}
+
+func (document *DocumentBase) UpdateAndFindSkipValidate(update interface{}, isNew bool) (err error) {
+	return document.updateAndFind(update, isNew, true)
+}
+
+func (document *DocumentBase) updateAndFind(update interface{}, isNew bool, skipValidate bool) (err error) {
 	if document.IsNew {
 		err = errors.New("Document isNew=true")
 		return
@@ -282,12 +384,19 @@ func (document *DocumentBase) UpdateAndFind(update interface{}, isNew bool) (err
 	id := documentOldv.FieldByName("ID").Interface()
 
 	query := document.Model.Query(document.Context)
+	if skipValidate {
+		query.SkipValidate()
+	}
 
 	// document
 	if err = query.ID(id).UpdateAndFind(update, documentV2.Interface(), isNew); err != nil {
 		return
 	}
 	documentV1.Elem().Set(documentV2.Elem())
+
+	if err = document.Model.DoHistory(document.Context, "update", id, document.Old); err != nil {
+		return
+	}
 	return
 }
 
@@ -297,6 +406,9 @@ func (document *DocumentBase) Delete() (err error) {
 	if err = document.Model.Query(document.Context).ID(id).NeDeleted().Delete(); err != nil {
 		return
 	}
+	if err = document.Model.DoHistory(document.Context, "delete", id, document.Old); err != nil {
+		return
+	}
 	return
 }
 func (document *DocumentBase) Restore() (err error) {
@@ -305,11 +417,14 @@ func (document *DocumentBase) Restore() (err error) {
 	if err = document.Model.Query(document.Context).ID(id).EqDeleted().Restore(); err != nil {
 		return
 	}
+	if err = document.Model.DoHistory(document.Context, "restore", id, document.Old); err != nil {
+		return
+	}
 	return
 }
 
 func (document *DocumentBase) Populate(doc DocumentInterface) *DocumentPopulate {
-	return &DocumentPopulate{Document: doc}
+	return &DocumentPopulate{Context: document.Context, Document: doc}
 }
 
 func (documentPopulate *DocumentPopulate) Path(path string, value *Query) *DocumentPopulate {
@@ -322,11 +437,110 @@ func (documentPopulate *DocumentPopulate) Path(path string, value *Query) *Docum
 
 func (documentPopulate *DocumentPopulate) Exec() (err error) {
 	if documentPopulate.Populate != nil {
-		err = documentPopulate.Populate.One(documentPopulate.Document)
+		ctx := documentPopulate.Context
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		err = documentPopulate.Populate.OneContext(ctx, documentPopulate.Document)
+	}
+	return
+}
+
+// documentCopy 复制 bson 字段 map slice 不共用 不包括 DocumentBase 和填充的字段
+func documentCopy(dst, src reflect.Value) (err error) {
+	dst = reflect.Indirect(dst)
+	if src, err = documentClone(src); err != nil {
+		return
+	}
+	src = src.Elem()
+	var documentStruct DocumentStruct
+	if documentStruct, err = DocumentStructParse(dst.Type()); err != nil {
+		return
+	}
+	for _, fieldStruct := range documentStruct {
+		if fieldStruct.BSON == "" {
+			continue
+		}
+		dst.Field(fieldStruct.Index).Set(src.Field(fieldStruct.Index))
 	}
 	return
 }
 
+// documentClone 返回深复制的指针 bson 字段深复制 其他字段浅复制
+func documentClone(src reflect.Value) (clone reflect.Value, err error) {
+	src = reflect.Indirect(src)
+	var documentStruct DocumentStruct
+	if documentStruct, err = DocumentStructParse(src.Type()); err != nil {
+		return
+	}
+	clone = reflect.New(src.Type())
+	clone.Elem().Set(src)
+	for _, fieldStruct := range documentStruct {
+		if fieldStruct.BSON == "" {
+			continue
+		}
+		clone.Elem().Field(fieldStruct.Index).Set(reflectDeepCopy(src.Field(fieldStruct.Index)))
+	}
+	return
+}
+
+// reflectDeepCopy 深复制 指针 map slice interface 结构体储存的导出字段 time.Time 等未导出字段的值不变
+func reflectDeepCopy(value reflect.Value) reflect.Value {
+	switch value.Kind() {
+	case reflect.Ptr:
+		if value.IsNil() {
+			return value
+		}
+		clone := reflect.New(value.Type().Elem())
+		clone.Elem().Set(reflectDeepCopy(value.Elem()))
+		return clone
+	case reflect.Interface:
+		if value.IsNil() {
+			return value
+		}
+		clone := reflect.New(value.Type()).Elem()
+		clone.Set(reflectDeepCopy(value.Elem()))
+		return clone
+	case reflect.Map:
+		if value.IsNil() {
+			return value
+		}
+		clone := reflect.MakeMapWithSize(value.Type(), value.Len())
+		for _, key := range value.MapKeys() {
+			clone.SetMapIndex(key, reflectDeepCopy(value.MapIndex(key)))
+		}
+		return clone
+	case reflect.Slice:
+		if value.IsNil() {
+			return value
+		}
+		clone := reflect.MakeSlice(value.Type(), value.Len(), value.Len())
+		for i := 0; i < value.Len(); i++ {
+			clone.Index(i).Set(reflectDeepCopy(value.Index(i)))
+		}
+		return clone
+	case reflect.Array:
+		clone := reflect.New(value.Type()).Elem()
+		for i := 0; i < value.Len(); i++ {
+			clone.Index(i).Set(reflectDeepCopy(value.Index(i)))
+		}
+		return clone
+	case reflect.Struct:
+		clone := reflect.New(value.Type()).Elem()
+		clone.Set(value)
+		typ := value.Type()
+		for i := 0; i < typ.NumField(); i++ {
+			// 不储存的 (DocumentBase 填充的) 浅复制
+			if field := typ.Field(i); field.PkgPath != "" || field.Tag.Get("bson") == "-" {
+				continue
+			}
+			clone.Field(i).Set(reflectDeepCopy(value.Field(i)))
+		}
+		return clone
+	}
+	return value
+}
+
 func ValueModified(base []string, depth int, v1, v2 reflect.Value) (paths []string) {
 	return paths
 }
@@ -451,15 +665,44 @@ func DocumentStructParse(t reflect.Type) (documentStruct DocumentStruct, err err
 			bsonName = ""
 		}
 
-		populateTag := strings.SplitN(field.Tag.Get("populate"), ",", 2)
+		populateTag := strings.Split(field.Tag.Get("populate"), ",")
 		populateName := populateTag[0]
 		var populateFind string
-		if len(populateTag) == 2 {
+		if len(populateTag) > 1 {
 			populateFind = populateTag[1]
 		}
 		if populateName == "-" {
 			populateName = ""
 		}
+		var populateReverse, populateCount, populateExists bool
+		var populateDiscriminator string
+		for i := 2; i < len(populateTag); i++ {
+			switch flag := populateTag[i]; {
+			case flag == "reverse":
+				populateReverse = true
+			case flag == "count":
+				populateCount = true
+			case flag == "exists":
+				populateExists = true
+			case strings.HasPrefix(flag, "type="):
+				populateDiscriminator = strings.TrimPrefix(flag, "type=")
+			default:
+				err = fmt.Errorf("Document field %s.%s populate %s unknown", t.String(), field.Name, flag)
+				return
+			}
+		}
+		if (populateCount || populateExists) && populateFind == "" {
+			err = fmt.Errorf("Document field %s.%s populate count without find", t.String(), field.Name)
+			return
+		}
+		if populateDiscriminator != "" && (populateReverse || populateCount || populateExists) {
+			err = fmt.Errorf("Document field %s.%s populate type with reverse, count, exists", t.String(), field.Name)
+			return
+		}
+		if populateReverse && populateFind == "" {
+			err = fmt.Errorf("Document field %s.%s populate reverse without find", t.String(), field.Name)
+			return
+		}
 		if populateFind != "" && populateName == "" {
 			populateName = "ID"
 		}
@@ -478,6 +721,19 @@ func DocumentStructParse(t reflect.Type) (documentStruct DocumentStruct, err err
 			JSONOmitempty: len(jsonTag) > 1 && jsonTag[1] == "omitempty",
 			BSON:          bsonName,
 			BSONOmitempty: len(bsonTag) > 1 && bsonTag[1] == "omitempty",
+			Type:          field.Type,
+		}
+
+		// index
+		if value.Indexs, err = DocumentStructIndexParse(field.Tag.Get("index")); err != nil {
+			err = fmt.Errorf("Document field %s.%s %s", t.String(), field.Name, err.Error())
+			return
+		}
+
+		// 验证规则
+		if value.Validate, err = ValidateRuleParse(field.Tag.Get("validate")); err != nil {
+			err = fmt.Errorf("Document field %s.%s %s", t.String(), field.Name, err.Error())
+			return
 		}
 
 		if populateName != "" {
@@ -486,6 +742,22 @@ func DocumentStructParse(t reflect.Type) (documentStruct DocumentStruct, err err
 				value.Populate.Index = field.Index[0]
 				value.Populate.Name = populateName
 				value.Populate.Find = populateFind
+				value.Populate.Reverse = populateReverse
+				value.Populate.Count = populateCount
+				value.Populate.Exists = populateExists
+				if value.Populate.DBRef = isDBRef(field.Type); value.Populate.DBRef && (populateReverse || populateCount || populateExists || populateDiscriminator != "") {
+					err = fmt.Errorf("Document field %s.%s populate dbref with reverse, count, exists, type", t.String(), populateName)
+					return
+				}
+			}
+			if populateDiscriminator != "" {
+				field, ok := t.FieldByName(populateDiscriminator)
+				if !ok || field.Type.Kind() != reflect.String {
+					err = fmt.Errorf("Document %s populate type %s not string field", t.String(), populateDiscriminator)
+					return
+				}
+				value.Populate.Discriminator = populateDiscriminator
+				value.Populate.DiscriminatorIndex = field.Index[0]
 			}
 		} else if value.BSON != "" {
 			elem := field.Type
@@ -0,0 +1,105 @@
+package model
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type (
+	documentTestAddress struct {
+		City string `bson:"city"`
+	}
+
+	documentTestDocument struct {
+		DocumentBase `json:"-" bson:"-"`
+		ID           int                    `bson:"_id"`
+		Name         string                 `bson:"name"`
+		Tags         []string               `bson:"tags,omitempty"`
+		Meta         map[string]interface{} `bson:"meta"`
+		Address      *documentTestAddress   `bson:"address"`
+		CreatedAt    time.Time              `bson:"createdAt"`
+		Owner        *documentTestDocument  `bson:"-"`
+	}
+)
+
+func TestDocumentVersions(t *testing.T) {
+	document := &documentTestDocument{ID: 1, Name: "a", Tags: []string{}, Meta: map[string]interface{}{"k": []interface{}{1}}, Address: &documentTestAddress{City: "c"}, CreatedAt: time.Now()}
+	document.New(context.Background(), nil, document, false)
+
+	// Old 浅复制 time 空切片 和 Ref 相同
+	old := document.Old.(*documentTestDocument)
+	if !reflect.DeepEqual(old.CreatedAt, document.CreatedAt) || old.Tags == nil {
+		t.Errorf("old = %#v", old)
+	}
+	for _, name := range []string{"CreatedAt", "Tags", "Meta", "Address"} {
+		if document.IsModified(name) {
+			t.Errorf("%s modified after New", name)
+		}
+	}
+
+	// 快照 深复制
+	document.Name = "b"
+	document.Tags = append(document.Tags, "x")
+	document.Meta["k"].([]interface{})[0] = 2
+	document.Address.City = "d"
+	version := document.Versions[0].(*documentTestDocument)
+	if version.Name != "a" || len(version.Tags) != 0 || version.Tags == nil || version.Meta["k"].([]interface{})[0] != 1 || version.Address.City != "c" || !reflect.DeepEqual(version.CreatedAt, document.CreatedAt) {
+		t.Errorf("version = %#v", version)
+	}
+	if version.Ref != nil || version.Old != nil || version.Versions != nil {
+		t.Errorf("version base = %#v", version.DocumentBase)
+	}
+
+	document.ResetDocumentOld()
+	if len(document.Versions) != 2 {
+		t.Fatalf("versions = %d", len(document.Versions))
+	}
+
+	// 重置 不影响快照 不修改填充的字段
+	owner := &documentTestDocument{ID: 2}
+	document.Owner = owner
+	if err := document.Reset(1); err != nil {
+		t.Fatal(err)
+	}
+	if document.Name != "a" || document.Address.City != "c" || document.Owner != owner {
+		t.Errorf("reset document = %#v", document)
+	}
+	document.Address.City = "e"
+	if version.Address.City != "c" {
+		t.Errorf("reset shares snapshot")
+	}
+	if err := document.Reset(0); err != nil || document.Name != "b" {
+		t.Errorf("reset 0 name = %s, err = %v", document.Name, err)
+	}
+	if err := document.Reset(2); err == nil {
+		t.Errorf("reset not exists version")
+	}
+
+	// 最多 DocumentVersions 个
+	for i := 0; i < DocumentVersions+5; i++ {
+		document.ResetDocumentOld()
+	}
+	if len(document.Versions) != DocumentVersions {
+		t.Errorf("versions = %d", len(document.Versions))
+	}
+}
+
+func TestDocumentCopy(t *testing.T) {
+	owner := &documentTestDocument{ID: 2}
+	dst := &documentTestDocument{ID: 1, Name: "a", Owner: owner}
+	src := &documentTestDocument{ID: 1, Name: "b", Tags: []string{"x"}}
+
+	// Revert 从历史记录复制 不覆盖填充的字段
+	if err := documentCopy(reflect.ValueOf(dst), reflect.ValueOf(src)); err != nil {
+		t.Fatal(err)
+	}
+	if dst.Name != "b" || dst.Owner != owner || len(dst.Tags) != 1 {
+		t.Errorf("dst = %#v", dst)
+	}
+	dst.Tags[0] = "y"
+	if src.Tags[0] != "x" {
+		t.Errorf("copy shares slice")
+	}
+}
@@ -0,0 +1,236 @@
+package model
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+type (
+	History struct {
+		ID         bson.ObjectId   `json:"id" bson:"_id"`
+		DocumentID interface{}     `json:"documentId" bson:"documentId"`
+		Model      string          `json:"model" bson:"model"`
+		Action     string          `json:"action" bson:"action"`
+		Version    int             `json:"version" bson:"version"`
+		Changes    []HistoryChange `json:"changes,omitempty" bson:"changes,omitempty"`
+		Actor      interface{}     `json:"actor,omitempty" bson:"actor,omitempty"`
+		Document   bson.Raw        `json:"-" bson:"document,omitempty"`
+		CreatedAt  time.Time       `json:"createdAt" bson:"createdAt"`
+	}
+
+	HistoryChange struct {
+		Path string      `json:"path" bson:"path"`
+		Old  interface{} `json:"old,omitempty" bson:"old,omitempty"`
+		New  interface{} `json:"new,omitempty" bson:"new,omitempty"`
+	}
+)
+
+// 操作人 context key
+var HISTORY_ACTOR = &contextKey{"actor"}
+
+// 版本号冲突时 重试次数
+var HistoryRetries = 10
+
+// WithHistoryActor 设置历史记录的操作人
+func WithHistoryActor(ctx context.Context, actor interface{}) context.Context {
+	return context.WithValue(ctx, HISTORY_ACTOR, actor)
+}
+
+func (model *Model) historyModel() *Model {
+	return &Model{
+		Name:           model.Name + "_history",
+		Tenant:         model.Tenant,
+		Session:        model.Session,
+		SessionOptions: model.SessionOptions,
+	}
+}
+
+// DoHistory 写入一条历史记录 document 从数据库重新读取 old 为操作之前的 document
+func (model *Model) DoHistory(ctx context.Context, action string, id interface{}, old interface{}) (err error) {
+	if !model.History {
+		return
+	}
+	history := &History{
+		ID:         bson.NewObjectId(),
+		DocumentID: id,
+		Model:      model.Name,
+		Action:     action,
+		Actor:      ctx.Value(HISTORY_ACTOR),
+		CreatedAt:  time.Now(),
+	}
+
+	documentStruct := model.DocumentStruct()
+
+	// 当前储存的 document 强制删除的 不存在
+	documentv := reflect.New(reflect.Indirect(reflect.ValueOf(model.Document)).Type())
+	var c *mgo.Collection
+	var cRelease func()
+	if c, cRelease, err = model.DBContext(ctx); err != nil {
+		return
+	}
+	defer cRelease()
+	// 刚写入的 从 primary 读取 不用 model 的读偏好
+	c.Database.Session.SetMode(mgo.Primary, true)
+	if err = c.FindId(id).One(documentv.Interface()); err == nil {
+		var data []byte
+		if data, err = bson.Marshal(documentv.Interface()); err != nil {
+			return
+		}
+		history.Document = bson.Raw{Kind: 0x03, Data: data}
+	} else if err == mgo.ErrNotFound {
+		documentv = reflect.Value{}
+		err = nil
+	} else {
+		return
+	}
+
+	var oldv reflect.Value
+	if old != nil {
+		oldv = reflect.ValueOf(old)
+	}
+	history.Changes = documentDiff(nil, documentStruct, reflect.Indirect(oldv), reflect.Indirect(documentv))
+	sort.Slice(history.Changes, func(i, j int) bool {
+		return history.Changes[i].Path < history.Changes[j].Path
+	})
+
+	var collection *mgo.Collection
+	var release func()
+	if collection, release, err = model.historyModel().DBContext(ctx); err != nil {
+		return
+	}
+	defer release()
+	collection.Database.Session.SetMode(mgo.Primary, true)
+
+	// 同时更新 版本号重复时 重新取最后的版本号
+	for i := 0; i < HistoryRetries; i++ {
+		last := &History{}
+		if err = collection.Find(bson.M{"documentId": id}).Select(bson.M{"version": 1}).Sort("-version").One(last); err != nil && err != mgo.ErrNotFound {
+			return
+		}
+		history.Version = last.Version + 1
+		if err = collection.Insert(history); err == nil || !mgo.IsDup(err) {
+			return
+		}
+	}
+	return
+}
+
+// Histories 列出 document 的历史记录 版本号 升序
+// 历史记录 不使用 model 的 DefaultScopes 调用之前 检查能否访问这个 document
+func (model *Model) Histories(ctx context.Context, id interface{}) (histories []History, err error) {
+	var collection *mgo.Collection
+	var release func()
+	if collection, release, err = model.historyModel().DBContext(ctx); err != nil {
+		return
+	}
+	defer release()
+	err = collection.Find(bson.M{"documentId": id}).Sort("version").All(&histories)
+	return
+}
+
+// HistoryAt 还原 document 在 at 时间的状态 不使用 DefaultScopes
+func (model *Model) HistoryAt(ctx context.Context, id interface{}, at time.Time, document interface{}) (err error) {
+	history := &History{}
+	var collection *mgo.Collection
+	var release func()
+	if collection, release, err = model.historyModel().DBContext(ctx); err != nil {
+		return
+	}
+	defer release()
+	if err = collection.Find(bson.M{"documentId": id, "createdAt": bson.M{"$lte": at}}).Sort("-version").One(history); err != nil {
+		return
+	}
+	return history.Unmarshal(document)
+}
+
+// HistoryVersion 读取 document 的某个版本 不存在 或 已经强制删除的 返回 mgo.ErrNotFound 不使用 DefaultScopes
+func (model *Model) HistoryVersion(ctx context.Context, id interface{}, version int, document interface{}) (err error) {
+	history := &History{}
+	var collection *mgo.Collection
+	var release func()
+	if collection, release, err = model.historyModel().DBContext(ctx); err != nil {
+		return
+	}
+	defer release()
+	if err = collection.Find(bson.M{"documentId": id, "version": version}).One(history); err != nil {
+		return
+	}
+	return history.Unmarshal(document)
+}
+
+// Unmarshal 解码记录的 document 已经强制删除的 返回 mgo.ErrNotFound
+func (history *History) Unmarshal(document interface{}) (err error) {
+	if len(history.Document.Data) == 0 {
+		err = mgo.ErrNotFound
+		return
+	}
+	err = history.Document.Unmarshal(document)
+	return
+}
+
+func (model *Model) updateHistory(ctx context.Context) (err error) {
+	if !model.History {
+		return
+	}
+	var collection *mgo.Collection
+	var release func()
+	if collection, release, err = model.historyModel().DBContext(ctx); err != nil {
+		return
+	}
+	defer release()
+	err = collection.EnsureIndex(mgo.Index{Key: []string{"documentId", "version"}, Unique: true})
+	return
+}
+
+// documentDiff 比较 bson 字段 v1 旧 v2 新 无效的 为空
+func documentDiff(base []string, documentStruct DocumentStruct, v1, v2 reflect.Value) (changes []HistoryChange) {
+	for _, fieldStruct := range documentStruct {
+		if fieldStruct.BSON == "" {
+			continue
+		}
+		path := append(append([]string{}, base...), fieldStruct.BSON)
+
+		var f1, f2 reflect.Value
+		if v1.IsValid() {
+			f1 = v1.Field(fieldStruct.Index)
+		}
+		if v2.IsValid() {
+			f2 = v2.Field(fieldStruct.Index)
+		}
+
+		// 嵌套结构体 遍历子级
+		if fieldStruct.Children != nil && (f1.IsValid() || f2.IsValid()) {
+			kind := f1.Kind()
+			if !f1.IsValid() {
+				kind = f2.Kind()
+			}
+			if kind == reflect.Struct {
+				changes = append(changes, documentDiff(path, fieldStruct.Children, f1, f2)...)
+				continue
+			}
+		}
+
+		var i1, i2 interface{}
+		if f1.IsValid() && !reflectValueZero(f1) {
+			i1 = f1.Interface()
+		}
+		if f2.IsValid() && !reflectValueZero(f2) {
+			i2 = f2.Interface()
+		}
+		if reflect.DeepEqual(i1, i2) {
+			continue
+		}
+		changes = append(changes, HistoryChange{Path: strings.Join(path, "."), Old: i1, New: i2})
+	}
+	return
+}
+
+func reflectValueZero(value reflect.Value) bool {
+	return reflect.DeepEqual(value.Interface(), reflect.Zero(value.Type()).Interface())
+}
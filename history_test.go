@@ -0,0 +1,77 @@
+package model
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+type (
+	historyTestAddress struct {
+		City string `bson:"city"`
+	}
+
+	historyTestDocument struct {
+		DocumentBase `json:"-" bson:"-"`
+		ID           int                `bson:"_id"`
+		Name         string             `bson:"name"`
+		Tags         []string           `bson:"tags"`
+		Address      historyTestAddress `bson:"address"`
+		Ignored      string             `bson:"-"`
+	}
+)
+
+func TestDocumentDiff(t *testing.T) {
+	documentStruct, err := DocumentStructParse(reflect.TypeOf(&historyTestDocument{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := &historyTestDocument{ID: 1, Name: "a", Tags: []string{"x"}, Address: historyTestAddress{City: "c"}}
+	tests := []struct {
+		name    string
+		old     *historyTestDocument
+		new     *historyTestDocument
+		changes []HistoryChange
+	}{
+		{name: "equal", old: old, new: &historyTestDocument{ID: 1, Name: "a", Tags: []string{"x"}, Address: historyTestAddress{City: "c"}, Ignored: "i"}},
+		{name: "create", new: old, changes: []HistoryChange{{Path: "_id", New: 1}, {Path: "address.city", New: "c"}, {Path: "name", New: "a"}, {Path: "tags", New: []string{"x"}}}},
+		{name: "delete", old: old, changes: []HistoryChange{{Path: "_id", Old: 1}, {Path: "address.city", Old: "c"}, {Path: "name", Old: "a"}, {Path: "tags", Old: []string{"x"}}}},
+		{name: "update", old: old, new: &historyTestDocument{ID: 1, Name: "b", Address: historyTestAddress{City: "d"}}, changes: []HistoryChange{{Path: "address.city", Old: "c", New: "d"}, {Path: "name", Old: "a", New: "b"}, {Path: "tags", Old: []string{"x"}}}},
+	}
+	for _, test := range tests {
+		var v1, v2 reflect.Value
+		if test.old != nil {
+			v1 = reflect.ValueOf(test.old).Elem()
+		}
+		if test.new != nil {
+			v2 = reflect.ValueOf(test.new).Elem()
+		}
+		changes := documentDiff(nil, documentStruct, v1, v2)
+		sort.Slice(changes, func(i, j int) bool {
+			return changes[i].Path < changes[j].Path
+		})
+		if !reflect.DeepEqual(changes, test.changes) {
+			t.Errorf("%s: changes = %#v, want %#v", test.name, changes, test.changes)
+		}
+	}
+}
+
+func TestHistoryUnmarshal(t *testing.T) {
+	data, err := bson.Marshal(&historyTestDocument{ID: 1, Name: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	history := &History{Document: bson.Raw{Kind: 0x03, Data: data}}
+	document := &historyTestDocument{}
+	if err = history.Unmarshal(document); err != nil || document.ID != 1 || document.Name != "a" {
+		t.Errorf("document = %#v, err = %v", document, err)
+	}
+
+	// 强制删除的 没有 document
+	if err = (&History{}).Unmarshal(document); err != mgo.ErrNotFound {
+		t.Errorf("err = %v", err)
+	}
+}
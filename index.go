@@ -0,0 +1,514 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+type (
+	IndexOptions struct {
+		// 只返回计划 不修改
+		DryRun bool
+		// 不删除 Indexs 以外的 index
+		KeepUnmanaged bool
+		// 后台创建 不锁集合
+		Background bool
+		// 滚动创建 每个 index 修改完成后 等待这段时间 再修改下一个 让从节点同步
+		Rolling time.Duration
+		// 不能在线重建时 (text 等) 允许 先删除再创建
+		AllowOffline bool
+	}
+
+	// index 标签 多个用 ; 分开 partial 必须是最后一个
+	// index:"unique,sparse"
+	// index:"name=org_email,desc;ttl=3600"
+	// index:"text" index:"2dsphere" index:"hashed" index:"partial={\"status\":1}"
+	DocumentStructIndex struct {
+		// 相同 Name 的 组合为一个 index
+		Name          string
+		Kind          string
+		Unique        bool
+		Sparse        bool
+		ExpireAfter   time.Duration
+		PartialFilter bson.M
+	}
+
+	IndexChange struct {
+		// add, drop, rebuild
+		Action string    `json:"action"`
+		Name   string    `json:"name"`
+		Index  mgo.Index `json:"index"`
+		Reason string    `json:"reason"`
+	}
+)
+
+const (
+	IndexAdd     = "add"
+	IndexDrop    = "drop"
+	IndexRebuild = "rebuild"
+)
+
+func DocumentStructIndexParse(tag string) (indexs []DocumentStructIndex, err error) {
+	if tag == "" || tag == "-" {
+		return
+	}
+	for _, spec := range strings.Split(tag, ";") {
+		index := DocumentStructIndex{}
+		for spec != "" {
+			var item string
+			if strings.HasPrefix(spec, "partial=") {
+				item, spec = spec, ""
+			} else if i := strings.Index(spec, ","); i != -1 {
+				item, spec = spec[:i], spec[i+1:]
+			} else {
+				item, spec = spec, ""
+			}
+			var param string
+			if i := strings.Index(item, "="); i != -1 {
+				item, param = item[:i], item[i+1:]
+			}
+			switch item {
+			case "":
+			case "unique":
+				index.Unique = true
+			case "sparse":
+				index.Sparse = true
+			case "desc":
+				index.Kind = "-"
+			case "text", "2dsphere", "2d", "hashed":
+				index.Kind = item
+			case "name":
+				index.Name = param
+			case "ttl":
+				var seconds int
+				if seconds, err = strconv.Atoi(param); err != nil {
+					err = fmt.Errorf("index ttl=%s invalid", param)
+					return
+				}
+				index.ExpireAfter = time.Duration(seconds) * time.Second
+			case "partial":
+				if err = bson.UnmarshalJSON([]byte(param), &index.PartialFilter); err != nil {
+					err = fmt.Errorf("index partial=%s invalid", param)
+					return
+				}
+			default:
+				err = fmt.Errorf("index %s unknown", item)
+				return
+			}
+		}
+		indexs = append(indexs, index)
+	}
+	return
+}
+
+// DocumentStructIndexs 标签中的 index 嵌套的 使用 bson 路径
+func DocumentStructIndexs(documentStruct DocumentStruct) (indexs []mgo.Index) {
+	groups := map[string]int{}
+	documentStructIndexs(&indexs, groups, nil, documentStruct)
+	return
+}
+
+func documentStructIndexs(indexs *[]mgo.Index, groups map[string]int, base []string, documentStruct DocumentStruct) {
+	// 按字段顺序
+	fields := make([]DocumentStructField, 0, len(documentStruct))
+	for _, fieldStruct := range documentStruct {
+		fields = append(fields, fieldStruct)
+	}
+	sort.Slice(fields, func(i, j int) bool {
+		return fields[i].Index < fields[j].Index
+	})
+
+	for _, fieldStruct := range fields {
+		if fieldStruct.BSON == "" {
+			continue
+		}
+		path := strings.Join(append(append([]string{}, base...), fieldStruct.BSON), ".")
+		for _, val := range fieldStruct.Indexs {
+			var key string
+			switch val.Kind {
+			case "":
+				key = path
+			case "-":
+				key = "-" + path
+			case "2d":
+				key = "@" + path
+			default:
+				key = "$" + val.Kind + ":" + path
+			}
+
+			// 组合
+			if i, ok := groups[val.Name]; ok && val.Name != "" {
+				index := &(*indexs)[i]
+				index.Key = append(index.Key, key)
+				index.Unique = index.Unique || val.Unique
+				index.Sparse = index.Sparse || val.Sparse
+				if val.ExpireAfter != 0 {
+					index.ExpireAfter = val.ExpireAfter
+				}
+				if val.PartialFilter != nil {
+					index.PartialFilter = val.PartialFilter
+				}
+				continue
+			}
+			if val.Name != "" {
+				groups[val.Name] = len(*indexs)
+			}
+			*indexs = append(*indexs, mgo.Index{
+				Name:          val.Name,
+				Key:           []string{key},
+				Unique:        val.Unique,
+				Sparse:        val.Sparse,
+				ExpireAfter:   val.ExpireAfter,
+				PartialFilter: val.PartialFilter,
+			})
+		}
+		if fieldStruct.Children != nil {
+			documentStructIndexs(indexs, groups, append(append([]string{}, base...), fieldStruct.BSON), fieldStruct.Children)
+		}
+	}
+}
+
+// indexs 标签 和 Indexs 合并 设置了名字的 index 名字相同的 Indexs 优先
+func (model *Model) indexs() (indexs []mgo.Index) {
+	var values []mgo.Index
+	if model.Document != nil {
+		values = append(values, DocumentStructIndexs(model.DocumentStruct())...)
+	}
+	values = append(values, model.Indexs...)
+
+	names := map[string]int{}
+	for _, index := range values {
+		if index.Name == "" {
+			for _, field := range index.Key {
+				if index.Name != "" {
+					index.Name += "_"
+				}
+				field = strings.Replace(field, "@", "2d-", -1)
+				field = strings.Replace(field, ":", "-", -1)
+				field = strings.Replace(field, "$", "", -1)
+				field = strings.Replace(field, "+", "", -1)
+				index.Name += field
+			}
+		}
+		if i, ok := names[index.Name]; ok {
+			indexs[i] = index
+			continue
+		}
+		names[index.Name] = len(indexs)
+		indexs = append(indexs, index)
+	}
+	return
+}
+
+// PlanIndexes 对比服务器的 index 返回需要的修改
+func (model *Model) PlanIndexes(ctx context.Context, options IndexOptions) (changes []IndexChange, err error) {
+	var collection *mgo.Collection
+	var release func()
+	if collection, release, err = model.DBContext(ctx); err != nil {
+		return
+	}
+	defer release()
+	var oldIndexs []mgo.Index
+	oldIndexs, err = collection.Indexes()
+	if err != nil && !strings.HasSuffix(err.Error(), "doesn't exist") {
+		return
+	}
+	err = nil
+
+	changes = planIndexes(oldIndexs, model.indexs(), options)
+	return
+}
+
+// planIndexes 对比 服务器的 oldIndexs 和 声明的 indexs
+func planIndexes(oldIndexs []mgo.Index, indexs []mgo.Index, options IndexOptions) (changes []IndexChange) {
+	oldIndexMaps := map[string]mgo.Index{}
+	for _, index := range oldIndexs {
+		oldIndexMaps[index.Name] = index
+	}
+
+	managed := map[string]bool{"_id_": true}
+	for _, index := range indexs {
+		if options.Background {
+			index.Background = true
+		}
+		managed[index.Name] = true
+		oldIndex, ok := oldIndexMaps[index.Name]
+		if ok && indexEqual(oldIndex, index) {
+			continue
+		}
+		if ok {
+			changes = append(changes, IndexChange{Action: IndexRebuild, Name: index.Name, Index: index, Reason: indexReason(indexNormalize(oldIndex, index), indexNormalize(index, index))})
+		} else {
+			changes = append(changes, IndexChange{Action: IndexAdd, Name: index.Name, Index: index, Reason: "not exists"})
+		}
+	}
+
+	// 删除
+	if !options.KeepUnmanaged {
+		for _, index := range oldIndexs {
+			if !managed[index.Name] {
+				changes = append(changes, IndexChange{Action: IndexDrop, Name: index.Name, Index: index, Reason: "unmanaged"})
+			}
+		}
+	}
+
+	// 先创建 再删除
+	sort.SliceStable(changes, func(i, j int) bool {
+		if (changes[i].Action == IndexDrop) != (changes[j].Action == IndexDrop) {
+			return changes[j].Action == IndexDrop
+		}
+		return changes[i].Name < changes[j].Name
+	})
+	return
+}
+
+// SyncIndexes 执行 PlanIndexes 的修改 每次只修改一个 index
+// rebuild 先创建临时 index (key 后面加 _id) 再删除旧的 再用原来的名字创建 最后删除临时的
+// 不能创建临时 index 的 返回错误 AllowOffline 时 先删除再创建
+func (model *Model) SyncIndexes(ctx context.Context, options IndexOptions) (changes []IndexChange, err error) {
+	if changes, err = model.PlanIndexes(ctx, options); err != nil || options.DryRun {
+		return
+	}
+	var collection *mgo.Collection
+	var release func()
+	if collection, release, err = model.DBContext(ctx); err != nil {
+		return
+	}
+	defer release()
+	for i, change := range changes {
+		if i != 0 && options.Rolling > 0 {
+			select {
+			case <-time.After(options.Rolling):
+			case <-ctx.Done():
+				err = ctx.Err()
+				return
+			}
+		}
+		switch change.Action {
+		case IndexAdd:
+			err = collection.EnsureIndex(change.Index)
+		case IndexDrop:
+			err = collection.DropIndexName(change.Name)
+		case IndexRebuild:
+			err = indexRebuild(collection, change, options)
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// indexRebuild 重建期间 一直有临时 index 可以使用
+func indexRebuild(collection *mgo.Collection, change IndexChange, options IndexOptions) (err error) {
+	tmp, ok := indexRebuildTmp(change.Index)
+	if ok {
+		err = collection.EnsureIndex(tmp)
+	}
+	if !ok || indexConflict(err) {
+		if !options.AllowOffline {
+			if err == nil {
+				err = errors.New("no temporary index")
+			}
+			err = fmt.Errorf("index %s rebuild online: %s", change.Name, err.Error())
+			return
+		}
+		if err = collection.DropIndexName(change.Name); err != nil {
+			return
+		}
+		err = collection.EnsureIndex(change.Index)
+		return
+	}
+	if err != nil {
+		return
+	}
+	if err = collection.DropIndexName(change.Name); err != nil {
+		return
+	}
+	if err = collection.EnsureIndex(change.Index); err != nil {
+		return
+	}
+	err = collection.DropIndexName(tmp.Name)
+	return
+}
+
+// indexRebuildTmp 临时 index key 后面加 _id 和新旧 index 都不冲突 不唯一 没有 ttl
+// text hashed 和 已经有 _id 的 不能创建
+func indexRebuildTmp(index mgo.Index) (tmp mgo.Index, ok bool) {
+	for _, key := range index.Key {
+		field := strings.TrimLeft(key, "+-@")
+		if strings.HasPrefix(key, "$") {
+			if !strings.HasPrefix(key, "$2dsphere:") {
+				return
+			}
+			field = key[len("$2dsphere:"):]
+		}
+		if field == "_id" {
+			return
+		}
+	}
+	tmp = index
+	tmp.Name = index.Name + "_tmp"
+	tmp.Key = append(append([]string{}, index.Key...), "_id")
+	tmp.Unique = false
+	tmp.DropDups = false
+	tmp.ExpireAfter = 0
+	ok = true
+	return
+}
+
+// indexEqual 服务器的 index1 和 声明的 index2 忽略服务器填充的默认值
+func indexEqual(index1, index2 mgo.Index) bool {
+	return reflect.DeepEqual(indexNormalize(index1, index2), indexNormalize(index2, index2))
+}
+
+// indexNormalize 填充服务器的默认值 text 的 weights language  collation 的默认值
+// declared 没有 collation 的 使用集合的 不比较
+func indexNormalize(index mgo.Index, declared mgo.Index) mgo.Index {
+	index.Name = ""
+	index.Background = false
+	index.DropDups = false
+	if declared.Collation == nil {
+		index.Collation = nil
+	} else {
+		index.Collation = collationNormalize(index.Collation)
+	}
+	if index.PartialFilter != nil {
+		index.PartialFilter = indexValueNormalize(index.PartialFilter).(bson.M)
+	}
+
+	// text 的字段 服务器按字段名排序 默认 weight 1
+	var texts []string
+	for _, key := range index.Key {
+		if strings.HasPrefix(key, "$text:") {
+			texts = append(texts, key)
+		}
+	}
+	if len(texts) == 0 {
+		return index
+	}
+	sort.Strings(texts)
+	key := make([]string, 0, len(index.Key))
+	weights := map[string]int{}
+	for _, val := range index.Key {
+		if !strings.HasPrefix(val, "$text:") {
+			key = append(key, val)
+		} else if len(texts) != 0 {
+			key = append(key, texts...)
+			texts = nil
+		}
+	}
+	for _, val := range key {
+		if strings.HasPrefix(val, "$text:") {
+			weights[val[len("$text:"):]] = 1
+		}
+	}
+	for name, weight := range index.Weights {
+		weights[name] = weight
+	}
+	index.Key = key
+	index.Weights = weights
+	if index.DefaultLanguage == "" {
+		index.DefaultLanguage = "english"
+	}
+	if index.LanguageOverride == "" {
+		index.LanguageOverride = "language"
+	}
+	return index
+}
+
+// collationNormalize 填充服务器的默认值 simple 为没有 collation
+func collationNormalize(collation *mgo.Collation) *mgo.Collation {
+	if collation == nil || collation.Locale == "simple" {
+		return nil
+	}
+	value := *collation
+	if value.CaseFirst == "" {
+		value.CaseFirst = "off"
+	}
+	if value.Strength == 0 {
+		value.Strength = 3
+	}
+	if value.Alternate == "" {
+		value.Alternate = "non-ignorable"
+	}
+	if value.MaxVariable == "" {
+		value.MaxVariable = "punct"
+	}
+	return &value
+}
+
+// indexValueNormalize 数字都用 float64 map 都用 bson.M 服务器返回 int 标签的 json 是 float64
+func indexValueNormalize(value interface{}) interface{} {
+	switch val := value.(type) {
+	case bson.M:
+		maps := bson.M{}
+		for name, v := range val {
+			maps[name] = indexValueNormalize(v)
+		}
+		return maps
+	case map[string]interface{}:
+		return indexValueNormalize(bson.M(val))
+	case bson.D:
+		return indexValueNormalize(val.Map())
+	case []interface{}:
+		values := make([]interface{}, len(val))
+		for i, v := range val {
+			values[i] = indexValueNormalize(v)
+		}
+		return values
+	case int:
+		return float64(val)
+	case int32:
+		return float64(val)
+	case int64:
+		return float64(val)
+	}
+	return value
+}
+
+func indexReason(index1, index2 mgo.Index) string {
+	var reasons []string
+	if !reflect.DeepEqual(index1.Key, index2.Key) {
+		reasons = append(reasons, "key")
+	}
+	if index1.Unique != index2.Unique {
+		reasons = append(reasons, "unique")
+	}
+	if index1.Sparse != index2.Sparse {
+		reasons = append(reasons, "sparse")
+	}
+	if index1.ExpireAfter != index2.ExpireAfter {
+		reasons = append(reasons, "expireAfter")
+	}
+	if !reflect.DeepEqual(index1.PartialFilter, index2.PartialFilter) {
+		reasons = append(reasons, "partialFilter")
+	}
+	if !reflect.DeepEqual(index1.Collation, index2.Collation) {
+		reasons = append(reasons, "collation")
+	}
+	if !reflect.DeepEqual(index1.Weights, index2.Weights) || index1.DefaultLanguage != index2.DefaultLanguage || index1.LanguageOverride != index2.LanguageOverride {
+		reasons = append(reasons, "text")
+	}
+	if len(reasons) == 0 {
+		reasons = append(reasons, "options")
+	}
+	return strings.Join(reasons, ",") + " changed"
+}
+
+// indexConflict IndexOptionsConflict IndexKeySpecsConflict
+func indexConflict(err error) bool {
+	if queryError, ok := err.(*mgo.QueryError); ok {
+		return queryError.Code == 85 || queryError.Code == 86
+	}
+	return false
+}
@@ -0,0 +1,166 @@
+package model
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+func TestDocumentStructIndexParse(t *testing.T) {
+	tests := []struct {
+		tag    string
+		indexs []DocumentStructIndex
+		err    bool
+	}{
+		{tag: ""},
+		{tag: "-"},
+		{tag: "unique,sparse", indexs: []DocumentStructIndex{{Unique: true, Sparse: true}}},
+		{tag: "name=org_email,desc;ttl=3600", indexs: []DocumentStructIndex{{Name: "org_email", Kind: "-"}, {ExpireAfter: time.Hour}}},
+		{tag: "text", indexs: []DocumentStructIndex{{Kind: "text"}}},
+		{tag: "2dsphere", indexs: []DocumentStructIndex{{Kind: "2dsphere"}}},
+		{tag: "hashed", indexs: []DocumentStructIndex{{Kind: "hashed"}}},
+		{tag: `sparse,partial={"status":1,"type":{"$in":[1,2]}}`, indexs: []DocumentStructIndex{{Sparse: true, PartialFilter: bson.M{"status": float64(1), "type": map[string]interface{}{"$in": []interface{}{float64(1), float64(2)}}}}}},
+		{tag: "ttl=x", err: true},
+		{tag: "partial={", err: true},
+		{tag: "unknown", err: true},
+	}
+	for _, test := range tests {
+		indexs, err := DocumentStructIndexParse(test.tag)
+		if (err != nil) != test.err {
+			t.Errorf("%q: err = %v", test.tag, err)
+			continue
+		}
+		if !test.err && !reflect.DeepEqual(indexs, test.indexs) {
+			t.Errorf("%q: indexs = %#v, want %#v", test.tag, indexs, test.indexs)
+		}
+	}
+}
+
+func TestPlanIndexes(t *testing.T) {
+	idIndex := mgo.Index{Name: "_id_", Key: []string{"_id"}}
+	email := mgo.Index{Name: "email", Key: []string{"email"}, Unique: true}
+	name := mgo.Index{Name: "name", Key: []string{"name"}}
+	other := mgo.Index{Name: "other", Key: []string{"other"}}
+	tmp := mgo.Index{Name: "email_tmp", Key: []string{"email", "_id"}}
+	emailSparse := email
+	emailSparse.Sparse = true
+	emailRenamed := email
+	emailRenamed.Name = "email_1"
+
+	// 服务器返回的 text index 有 weights language  字段按名字排序
+	text := mgo.Index{Name: "text", Key: []string{"$text:title", "$text:body"}}
+	serverText := mgo.Index{Name: "text", Key: []string{"$text:body", "$text:title"}, Weights: map[string]int{"body": 1, "title": 1}, DefaultLanguage: "english", LanguageOverride: "language"}
+	textWeights := text
+	textWeights.Weights = map[string]int{"title": 5}
+
+	// 集合有 collation 的 index 继承集合的 服务器返回完整的 collation
+	serverCollation := email
+	serverCollation.Collation = &mgo.Collation{Locale: "en", CaseFirst: "off", Strength: 3, Alternate: "non-ignorable", MaxVariable: "punct"}
+	emailCollation := email
+	emailCollation.Collation = &mgo.Collation{Locale: "en"}
+	emailStrength := email
+	emailStrength.Collation = &mgo.Collation{Locale: "en", Strength: 2}
+
+	// 服务器返回的数字是 int 标签 json 解析的是 float64
+	partial := mgo.Index{Name: "status", Key: []string{"status"}, PartialFilter: bson.M{"status": float64(1), "type": map[string]interface{}{"$in": []interface{}{float64(1)}}}}
+	serverPartial := mgo.Index{Name: "status", Key: []string{"status"}, PartialFilter: bson.M{"status": 1, "type": bson.M{"$in": []interface{}{1}}}}
+
+	tests := []struct {
+		name    string
+		old     []mgo.Index
+		indexs  []mgo.Index
+		options IndexOptions
+		changes []string
+	}{
+		{name: "equal", old: []mgo.Index{idIndex, email}, indexs: []mgo.Index{email}},
+		{name: "background", old: []mgo.Index{idIndex, email}, indexs: []mgo.Index{email}, options: IndexOptions{Background: true}},
+		{name: "add", old: []mgo.Index{idIndex}, indexs: []mgo.Index{name, email}, changes: []string{"add email", "add name"}},
+		{name: "rebuild", old: []mgo.Index{idIndex, email}, indexs: []mgo.Index{emailSparse}, changes: []string{"rebuild email"}},
+		{name: "drop after add", old: []mgo.Index{idIndex, other}, indexs: []mgo.Index{email}, changes: []string{"add email", "drop other"}},
+		{name: "keep unmanaged", old: []mgo.Index{idIndex, other}, indexs: []mgo.Index{email}, options: IndexOptions{KeepUnmanaged: true}, changes: []string{"add email"}},
+		{name: "renamed", old: []mgo.Index{idIndex, emailRenamed}, indexs: []mgo.Index{email}, changes: []string{"add email", "drop email_1"}},
+		{name: "server text", old: []mgo.Index{idIndex, serverText}, indexs: []mgo.Index{text}},
+		{name: "text weights", old: []mgo.Index{idIndex, serverText}, indexs: []mgo.Index{textWeights}, changes: []string{"rebuild text"}},
+		{name: "collection collation", old: []mgo.Index{idIndex, serverCollation}, indexs: []mgo.Index{email}},
+		{name: "collation defaults", old: []mgo.Index{idIndex, serverCollation}, indexs: []mgo.Index{emailCollation}},
+		{name: "collation strength", old: []mgo.Index{idIndex, serverCollation}, indexs: []mgo.Index{emailStrength}, changes: []string{"rebuild email"}},
+		{name: "partial numbers", old: []mgo.Index{idIndex, serverPartial}, indexs: []mgo.Index{partial}},
+		{name: "leftover tmp", old: []mgo.Index{idIndex, tmp}, indexs: []mgo.Index{email}, changes: []string{"add email", "drop email_tmp"}},
+	}
+	for _, test := range tests {
+		var changes []string
+		for _, change := range planIndexes(test.old, test.indexs, test.options) {
+			changes = append(changes, change.Action+" "+change.Name)
+			if change.Action != IndexDrop && change.Index.Background != test.options.Background {
+				t.Errorf("%s: %s background = %v", test.name, change.Name, change.Index.Background)
+			}
+		}
+		if !reflect.DeepEqual(changes, test.changes) {
+			t.Errorf("%s: changes = %v, want %v", test.name, changes, test.changes)
+		}
+	}
+}
+
+func TestIndexRebuildTmp(t *testing.T) {
+	tests := []struct {
+		index mgo.Index
+		key   []string
+		ok    bool
+	}{
+		{index: mgo.Index{Name: "email", Key: []string{"email"}, Unique: true}, key: []string{"email", "_id"}, ok: true},
+		{index: mgo.Index{Name: "expire", Key: []string{"-at"}, ExpireAfter: time.Hour}, key: []string{"-at", "_id"}, ok: true},
+		{index: mgo.Index{Name: "loc", Key: []string{"$2dsphere:loc"}}, key: []string{"$2dsphere:loc", "_id"}, ok: true},
+		{index: mgo.Index{Name: "text", Key: []string{"$text:title"}}},
+		{index: mgo.Index{Name: "hashed", Key: []string{"$hashed:org"}}},
+		{index: mgo.Index{Name: "id", Key: []string{"org", "-_id"}}},
+	}
+	for _, test := range tests {
+		tmp, ok := indexRebuildTmp(test.index)
+		if ok != test.ok {
+			t.Errorf("%s: ok = %v", test.index.Name, ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if tmp.Name != test.index.Name+"_tmp" || !reflect.DeepEqual(tmp.Key, test.key) || tmp.Unique || tmp.ExpireAfter != 0 {
+			t.Errorf("%s: tmp = %#v", test.index.Name, tmp)
+		}
+		if len(test.index.Key) == len(tmp.Key) {
+			t.Errorf("%s: key modified", test.index.Name)
+		}
+	}
+}
+
+type indexTestDocument struct {
+	DocumentBase `json:"-" bson:"-"`
+	ID           int    `bson:"_id"`
+	Title        string `bson:"title" index:"name=search,text"`
+	Body         string `bson:"body" index:"name=search,text"`
+	Email        string `bson:"email" index:"unique"`
+}
+
+func TestModelIndexsText(t *testing.T) {
+	model := &Model{Name: "posts", Document: &indexTestDocument{}}
+	indexs := model.indexs()
+	want := []mgo.Index{
+		{Name: "search", Key: []string{"$text:title", "$text:body"}},
+		{Name: "email", Key: []string{"email"}, Unique: true},
+	}
+	if !reflect.DeepEqual(indexs, want) {
+		t.Fatalf("indexs = %#v, want %#v", indexs, want)
+	}
+
+	// 服务器返回的 text index 不重建
+	server := []mgo.Index{
+		{Name: "_id_", Key: []string{"_id"}},
+		{Name: "search", Key: []string{"$text:body", "$text:title"}, Weights: map[string]int{"body": 1, "title": 1}, DefaultLanguage: "english", LanguageOverride: "language"},
+		{Name: "email", Key: []string{"email"}, Unique: true},
+	}
+	if changes := planIndexes(server, indexs, IndexOptions{}); len(changes) != 0 {
+		t.Errorf("changes = %v", changes)
+	}
+}
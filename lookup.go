@@ -0,0 +1,377 @@
+package model
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+type (
+	// queryLookup 一个用 $lookup 填充的路径
+	queryLookup struct {
+		as     string
+		path   string
+		field  DocumentStructField
+		target *Query
+		// 目标结构体的 Find 路径
+		findPath []reflectPath
+	}
+)
+
+// Lookup 第一级的填充路径 用一个 $lookup 聚合查询
+// 不能 $lookup 的 (多级路径 map count exists 多态 DBRef 跨数据库 有深度填充的) 仍然用 Populate
+// lookup 的路径 和 Populate 一样 按 Missing 处理不存在的 id 没有 sort 的按 id 顺序
+func (query *Query) Lookup() *Query {
+	query.Options.Lookup = true
+	return query
+}
+
+// lookupOne 查询一个 没有返回 mgo.ErrNotFound
+func (query *Query) lookupOne(collection *mgo.Collection, document interface{}) (err error) {
+	documentv := reflect.ValueOf(document)
+	if documentv.Kind() != reflect.Ptr {
+		err = errors.New("document argument must be a pointer")
+		return
+	}
+	slicePtr := reflect.New(reflect.SliceOf(documentv.Elem().Type()))
+	if err = query.lookupAll(collection, slicePtr.Interface(), 1); err != nil {
+		return
+	}
+	if slicePtr.Elem().Len() == 0 {
+		err = mgo.ErrNotFound
+		return
+	}
+	documentv.Elem().Set(slicePtr.Elem().Index(0))
+	return
+}
+
+// lookupAll 聚合查询 解码到 documents 剩下的路径 Populate
+func (query *Query) lookupAll(collection *mgo.Collection, documents interface{}, limit int) (err error) {
+	documentsv := reflect.ValueOf(documents)
+	if documentsv.Kind() != reflect.Ptr || documentsv.Elem().Kind() != reflect.Slice {
+		err = errors.New("documents argument must be a slice address")
+		return
+	}
+	slicev := documentsv.Elem()
+	elemTyp := slicev.Type().Elem()
+	var documentStruct DocumentStruct
+	if documentStruct, err = DocumentStructParse(elemTyp); err != nil {
+		return
+	}
+
+	var match bson.M
+	if match, err = query.Map(); err != nil {
+		return
+	}
+	pipeline := []bson.M{{"$match": match}}
+	if len(query.Options.Sort) != 0 {
+		pipeline = append(pipeline, bson.M{"$sort": lookupSort(query.Options.Sort)})
+	}
+	if query.Options.Skip > 0 {
+		pipeline = append(pipeline, bson.M{"$skip": query.Options.Skip})
+	}
+	if limit > 0 {
+		pipeline = append(pipeline, bson.M{"$limit": limit})
+	}
+
+	paths := make([]string, 0, len(query.Populate))
+	for path := range query.Populate {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	var lookups []queryLookup
+	var asNames []string
+	rest := Populate{}
+	for _, path := range paths {
+		var stages []bson.M
+		var lookup queryLookup
+		var ok bool
+		if stages, lookup, ok, err = query.lookupStages(collection, path, documentStruct); err != nil {
+			return
+		}
+		if !ok {
+			rest[path] = query.Populate[path]
+			continue
+		}
+		pipeline = append(pipeline, stages...)
+		lookups = append(lookups, lookup)
+		asNames = append(asNames, lookup.as)
+	}
+	if len(query.Options.Fields) != 0 {
+		pipeline = append(pipeline, bson.M{"$project": lookupProject(query.Options.Fields, asNames)})
+	}
+
+	var raws []bson.Raw
+	if err = collection.Pipe(pipeline).All(&raws); err != nil {
+		return
+	}
+
+	ctx := query.populateContext()
+	missings := make([]map[interface{}]bool, len(lookups))
+	missing := make([][]interface{}, len(lookups))
+	result := reflect.MakeSlice(slicev.Type(), 0, len(raws))
+	for _, raw := range raws {
+		elem := reflect.New(elemTyp)
+		if err = raw.Unmarshal(elem.Interface()); err != nil {
+			return
+		}
+		structV := elem.Elem()
+		if structV.Kind() == reflect.Ptr {
+			structV = structV.Elem()
+		}
+		if len(lookups) != 0 {
+			var values map[string]bson.Raw
+			if err = raw.Unmarshal(&values); err != nil {
+				return
+			}
+			for i, lookup := range lookups {
+				var ids []interface{}
+				if ids, err = lookup.assign(structV, values[lookup.as]); err != nil {
+					return
+				}
+				if missings[i] == nil {
+					missings[i] = map[interface{}]bool{}
+				}
+				for _, id := range ids {
+					if !missings[i][id] {
+						missings[i][id] = true
+						missing[i] = append(missing[i], id)
+					}
+				}
+			}
+		}
+		result = reflect.Append(result, elem.Elem())
+	}
+	slicev.Set(result)
+
+	for i, lookup := range lookups {
+		if err = populateMissing(ctx, lookup.path, lookup.target, missing[i]); err != nil {
+			return
+		}
+	}
+
+	if len(rest) != 0 {
+		err = rest.AllContext(ctx, documents)
+	}
+	return
+}
+
+// lookupStages 一个路径的 $lookup $unwind  ok 为 false 的用 Populate
+func (query *Query) lookupStages(collection *mgo.Collection, path string, documentStruct DocumentStruct) (stages []bson.M, lookup queryLookup, ok bool, err error) {
+	if strings.Contains(path, ".") {
+		return
+	}
+	var field DocumentStructField
+	if field, ok = documentStruct[path]; !ok || field.Populate.Name == "" {
+		ok = false
+		return
+	}
+	ok = false
+	if field.Populate.Count || field.Populate.Exists || field.Populate.Discriminator != "" || field.Populate.DBRef || field.Type == nil || field.Type.Kind() == reflect.Map {
+		return
+	}
+	target := query.Populate[path]
+	if target == nil {
+		if target, err = registryQuery(query.Context, []string{path}, field); err != nil {
+			return
+		}
+	}
+	if target.Populate != nil {
+		return
+	}
+	// 没有 sort 的 skip limit 是按 id 顺序的 $lookup 中不能按 id 排序
+	if len(target.Options.Sort) == 0 && (target.Options.Skip > 0 || target.Options.Limit > 0) && !field.Populate.Reverse && field.Type.Kind() == reflect.Slice {
+		return
+	}
+
+	// 只能 $lookup 同一个数据库的
+	var from string
+	if model, isModel := target.Model.(*Model); isModel {
+		var database string
+		if database, from, err = model.tenantNames(query.Context); err != nil {
+			return
+		}
+		if database != "" && database != collection.Database.Name {
+			return
+		}
+	} else {
+		names := strings.SplitN(target.Options.Name, ".", 2)
+		if len(names) == 2 && names[0] != collection.Database.Name {
+			return
+		}
+		from = names[len(names)-1]
+	}
+
+	var localName, foreignName string
+	var localField, foreignField DocumentStructField
+	var findPath []reflectPath
+	if localName, _, localField, err = populateFindPath([]string{field.Populate.Name}, documentStruct); err != nil {
+		return
+	}
+	if foreignName, findPath, foreignField, err = populateFindPath(strings.Split(field.Populate.Find, "."), target.Model.DocumentStruct()); err != nil {
+		return
+	}
+	local := "$$local"
+	foreign := "$" + foreignName
+	var expr bson.M
+	switch localSlice, foreignSlice := lookupSlice(localField), lookupSlice(foreignField); {
+	case localSlice && foreignSlice:
+		expr = bson.M{"$gt": []interface{}{bson.M{"$size": bson.M{"$setIntersection": []interface{}{bson.M{"$ifNull": []interface{}{foreign, []interface{}{}}}, bson.M{"$ifNull": []interface{}{local, []interface{}{}}}}}}, 0}}
+	case localSlice:
+		expr = bson.M{"$in": []interface{}{foreign, bson.M{"$ifNull": []interface{}{local, []interface{}{}}}}}
+	case foreignSlice:
+		expr = bson.M{"$in": []interface{}{local, bson.M{"$ifNull": []interface{}{foreign, []interface{}{}}}}}
+	default:
+		expr = bson.M{"$eq": []interface{}{foreign, local}}
+	}
+
+	var match bson.M
+	if match, err = target.Map(); err != nil {
+		return
+	}
+	single := field.Type.Kind() != reflect.Slice
+	subPipeline := []bson.M{{"$match": bson.M{"$and": []interface{}{bson.M{"$expr": expr}, match}}}}
+	if len(target.Options.Sort) != 0 {
+		subPipeline = append(subPipeline, bson.M{"$sort": lookupSort(target.Options.Sort)})
+	}
+	if target.Options.Skip > 0 {
+		subPipeline = append(subPipeline, bson.M{"$skip": target.Options.Skip})
+	}
+	if single {
+		subPipeline = append(subPipeline, bson.M{"$limit": 1})
+	} else if target.Options.Limit > 0 {
+		subPipeline = append(subPipeline, bson.M{"$limit": target.Options.Limit})
+	}
+	if len(target.Options.Fields) != 0 {
+		subPipeline = append(subPipeline, bson.M{"$project": target.Options.Fields})
+	}
+
+	lookup = queryLookup{as: "__populate_" + path, path: path, field: field, target: target, findPath: findPath}
+	stages = append(stages, bson.M{"$lookup": bson.M{
+		"from":     from,
+		"let":      bson.M{"local": "$" + localName},
+		"pipeline": subPipeline,
+		"as":       lookup.as,
+	}})
+	if single {
+		stages = append(stages, bson.M{"$unwind": bson.M{"path": "$" + lookup.as, "preserveNullAndEmptyArrays": true}})
+	}
+	ok = true
+	return
+}
+
+// assign 解码 $lookup 的结果 用 reflectAssign 按 id 顺序 填充到字段 返回不存在的 id
+func (lookup queryLookup) assign(structV reflect.Value, value bson.Raw) (missing []interface{}, err error) {
+	field := structV.Field(lookup.field.Index)
+	elemTyp := field.Type()
+	if elemTyp.Kind() == reflect.Slice {
+		elemTyp = elemTyp.Elem()
+	}
+	fetchValue := reflect.MakeSlice(reflect.SliceOf(elemTyp), 0, 0)
+	// 0x0A null 单个的 $unwind 后是 document 没有的 不存在
+	switch {
+	case value.Kind == 0 || value.Kind == 0x0A:
+	case value.Kind == 0x04:
+		slicePtr := reflect.New(fetchValue.Type())
+		if err = value.Unmarshal(slicePtr.Interface()); err != nil {
+			return
+		}
+		fetchValue = slicePtr.Elem()
+	default:
+		elem := reflect.New(elemTyp)
+		if err = value.Unmarshal(elem.Interface()); err != nil {
+			return
+		}
+		fetchValue = reflect.Append(fetchValue, elem.Elem())
+	}
+
+	var fetchIDs [][]interface{}
+	for i := 0; i < fetchValue.Len(); i++ {
+		fetchIDs = append(fetchIDs, reflectIDs(fetchValue.Index(i), lookup.findPath))
+	}
+	findValue := reflectValue{value: field, ids: lookupIDs(structV.Field(lookup.field.Populate.Index))}
+	if len(findValue.ids) == 0 {
+		return
+	}
+
+	// skip limit 已经在 $lookup 中
+	q := *lookup.target
+	q.Options.Skip = 0
+	q.Options.Limit = 0
+	var fetched map[interface{}]bool
+	if !lookup.field.Populate.Reverse {
+		fetched = make(map[interface{}]bool, len(findValue.ids))
+		for _, id := range findValue.ids {
+			fetched[id] = true
+		}
+	}
+	missing = reflectAssign([]reflectValue{findValue}, fetchValue, fetchIDs, &q, fetched)
+	return
+}
+
+// lookupIDs 本结构体储存 id 的字段 切片的每个元素
+func lookupIDs(value reflect.Value) (ids []interface{}) {
+	for value.Kind() == reflect.Ptr || value.Kind() == reflect.Interface {
+		value = value.Elem()
+	}
+	if value.Kind() == reflect.Slice && value.Type().Elem().Kind() != reflect.Uint8 {
+		for i := 0; i < value.Len(); i++ {
+			if val := value.Index(i); !reflectValueEmpty(val) {
+				ids = append(ids, val.Interface())
+			}
+		}
+		return
+	}
+	if !reflectValueEmpty(value) {
+		ids = append(ids, value.Interface())
+	}
+	return
+}
+
+// lookupSlice 字段是否是数组 []byte 不是
+func lookupSlice(field DocumentStructField) bool {
+	return field.Type != nil && field.Type.Kind() == reflect.Slice && field.Type.Elem().Kind() != reflect.Uint8
+}
+
+// lookupSort Sort 的 "-name" 格式 转换为 $sort
+func lookupSort(fields []string) (sort bson.D) {
+	for _, field := range fields {
+		order := 1
+		switch {
+		case strings.HasPrefix(field, "-"):
+			order = -1
+			field = field[1:]
+		case strings.HasPrefix(field, "+"):
+			field = field[1:]
+		}
+		sort = append(sort, bson.DocElem{Name: field, Value: order})
+	}
+	return
+}
+
+// lookupProject 包含字段的 $project 加上 $lookup 的字段
+func lookupProject(fields map[string]interface{}, asNames []string) bson.M {
+	project := bson.M{}
+	include := false
+	for key, value := range fields {
+		project[key] = value
+		switch value := value.(type) {
+		case int:
+			include = include || value != 0
+		case bool:
+			include = include || value
+		default:
+			include = true
+		}
+	}
+	if include {
+		for _, as := range asNames {
+			project[as] = 1
+		}
+	}
+	return project
+}
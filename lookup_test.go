@@ -0,0 +1,170 @@
+package model
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+type (
+	lookupTestUser struct {
+		DocumentBase `json:"-" bson:"-"`
+		ID           int              `bson:"_id"`
+		Name         string           `bson:"name"`
+		Posts        []lookupTestPost `bson:"-" populate:"ID,UserID,reverse"`
+		PostCount    int              `bson:"-" populate:"ID,UserID,count"`
+	}
+
+	lookupTestPost struct {
+		DocumentBase `json:"-" bson:"-"`
+		ID           int              `bson:"_id"`
+		UserID       int              `bson:"user"`
+		TagIDs       []int            `bson:"tags"`
+		User         *lookupTestUser  `bson:"-" populate:"UserID"`
+		Tags         []lookupTestUser `bson:"-" populate:"TagIDs"`
+	}
+)
+
+func TestLookupStages(t *testing.T) {
+	ctx := context.Background()
+	users := &Model{Name: "test.users", Document: &lookupTestUser{}}
+	posts := &Model{Name: "test.posts", Document: &lookupTestPost{}}
+	others := &Model{Name: "other.users", Document: &lookupTestUser{}}
+	collection := &mgo.Collection{Database: &mgo.Database{Name: "test"}, Name: "posts", FullName: "test.posts"}
+
+	tests := []struct {
+		name     string
+		path     string
+		document DocumentStruct
+		target   *Query
+		ok       bool
+		expr     bson.M
+		limit    bool
+		unwind   bool
+	}{
+		{name: "single", path: "User", document: posts.DocumentStruct(), target: users.Query(ctx), ok: true, expr: bson.M{"$eq": []interface{}{"$_id", "$$local"}}, limit: true, unwind: true},
+		{name: "local slice", path: "Tags", document: posts.DocumentStruct(), target: users.Query(ctx), ok: true, expr: bson.M{"$in": []interface{}{"$_id", bson.M{"$ifNull": []interface{}{"$$local", []interface{}{}}}}}},
+		{name: "reverse", path: "Posts", document: users.DocumentStruct(), target: posts.Query(ctx), ok: true, expr: bson.M{"$eq": []interface{}{"$user", "$$local"}}},
+		{name: "nested", path: "User.Posts", document: posts.DocumentStruct(), target: users.Query(ctx)},
+		{name: "count", path: "PostCount", document: users.DocumentStruct(), target: posts.Query(ctx)},
+		{name: "other database", path: "User", document: posts.DocumentStruct(), target: others.Query(ctx)},
+		{name: "deep populate", path: "User", document: posts.DocumentStruct(), target: users.Query(ctx).PopulatePath("Posts", nil)},
+		{name: "not populate", path: "UserID", document: posts.DocumentStruct(), target: users.Query(ctx)},
+	}
+	for _, test := range tests {
+		query := posts.Query(ctx).PopulatePath(test.path, test.target)
+		stages, lookup, ok, err := query.lookupStages(collection, test.path, test.document)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if ok != test.ok {
+			t.Errorf("%s: ok = %v", test.name, ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if lookup.as != "__populate_"+test.path {
+			t.Errorf("%s: as = %s", test.name, lookup.as)
+		}
+		if (len(stages) == 2) != test.unwind {
+			t.Errorf("%s: stages = %v", test.name, stages)
+			continue
+		}
+		stage := stages[0]["$lookup"].(bson.M)
+		if stage["from"] != "users" && stage["from"] != "posts" {
+			t.Errorf("%s: from = %v", test.name, stage["from"])
+		}
+		pipeline := stage["pipeline"].([]bson.M)
+		match := pipeline[0]["$match"].(bson.M)["$and"].([]interface{})
+		if expr := match[0].(bson.M)["$expr"]; !reflect.DeepEqual(expr, test.expr) {
+			t.Errorf("%s: expr = %#v, want %#v", test.name, expr, test.expr)
+		}
+		if _, limit := pipeline[len(pipeline)-1]["$limit"]; limit != test.limit {
+			t.Errorf("%s: pipeline = %v", test.name, pipeline)
+		}
+	}
+}
+
+func TestQueryLookupAssign(t *testing.T) {
+	ctx := context.Background()
+	users := &Model{Name: "test.users", Document: &lookupTestUser{}}
+	posts := &Model{Name: "test.posts", Document: &lookupTestPost{}}
+	raw := func(value interface{}) bson.Raw {
+		data, err := bson.Marshal(bson.M{"v": value})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var values map[string]bson.Raw
+		if err = bson.Unmarshal(data, &values); err != nil {
+			t.Fatal(err)
+		}
+		return values["v"]
+	}
+	lookup := func(path string, document DocumentStruct, target *Query) queryLookup {
+		collection := &mgo.Collection{Database: &mgo.Database{Name: "test"}, Name: "posts", FullName: "test.posts"}
+		_, lookup, ok, err := posts.Query(ctx).PopulatePath(path, target).lookupStages(collection, path, document)
+		if err != nil || !ok {
+			t.Fatalf("%s: ok = %v, err = %v", path, ok, err)
+		}
+		return lookup
+	}
+
+	// id 顺序 不存在的 id
+	tags := lookup("Tags", posts.DocumentStruct(), users.Query(ctx))
+	post := lookupTestPost{TagIDs: []int{3, 1, 2}}
+	missing, err := tags.assign(reflect.ValueOf(&post).Elem(), raw([]bson.M{{"_id": 1}, {"_id": 3}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(post.Tags) != 2 || post.Tags[0].ID != 3 || post.Tags[1].ID != 1 {
+		t.Errorf("tags = %v", post.Tags)
+	}
+	if !reflect.DeepEqual(missing, []interface{}{2}) {
+		t.Errorf("missing = %v", missing)
+	}
+
+	// PopulateMissingNil 保留位置
+	post = lookupTestPost{TagIDs: []int{3, 2}}
+	tags = lookup("Tags", posts.DocumentStruct(), users.Query(ctx).Missing(PopulateMissingNil))
+	if _, err = tags.assign(reflect.ValueOf(&post).Elem(), raw([]bson.M{{"_id": 3}})); err != nil {
+		t.Fatal(err)
+	}
+	if len(post.Tags) != 2 || post.Tags[0].ID != 3 || post.Tags[1].ID != 0 {
+		t.Errorf("nil tags = %v", post.Tags)
+	}
+
+	// 单个 $unwind 后的 document 和 不存在的
+	user := lookup("User", posts.DocumentStruct(), users.Query(ctx))
+	post = lookupTestPost{UserID: 1}
+	if missing, err = user.assign(reflect.ValueOf(&post).Elem(), raw(bson.M{"_id": 1, "name": "a"})); err != nil || missing != nil {
+		t.Fatalf("missing = %v, err = %v", missing, err)
+	}
+	if post.User == nil || post.User.Name != "a" {
+		t.Errorf("user = %v", post.User)
+	}
+	post = lookupTestPost{UserID: 2}
+	if missing, err = user.assign(reflect.ValueOf(&post).Elem(), bson.Raw{}); err != nil || !reflect.DeepEqual(missing, []interface{}{2}) {
+		t.Errorf("missing = %v, err = %v", missing, err)
+	}
+
+	// reverse 没有不存在的
+	reverse := lookup("Posts", users.DocumentStruct(), posts.Query(ctx))
+	author := lookupTestUser{ID: 1}
+	if missing, err = reverse.assign(reflect.ValueOf(&author).Elem(), raw([]bson.M{{"_id": 5, "user": 1}, {"_id": 4, "user": 1}})); err != nil || missing != nil {
+		t.Fatalf("missing = %v, err = %v", missing, err)
+	}
+	if len(author.Posts) != 2 || author.Posts[0].ID != 5 {
+		t.Errorf("posts = %v", author.Posts)
+	}
+
+	// 没有 sort 有 limit 的 不能按 id 顺序 用 Populate
+	collection := &mgo.Collection{Database: &mgo.Database{Name: "test"}, Name: "posts", FullName: "test.posts"}
+	if _, _, ok, _ := posts.Query(ctx).PopulatePath("Tags", users.Query(ctx).Limit(1)).lookupStages(collection, "Tags", posts.DocumentStruct()); ok {
+		t.Errorf("limit without sort uses $lookup")
+	}
+}
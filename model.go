@@ -5,6 +5,7 @@ import (
 	"log"
 	"reflect"
 	"strings"
+	"time"
 
 	"github.com/globalsign/mgo"
 )
@@ -15,12 +16,23 @@ type (
 	ModelInterface interface {
 		OnEvent(name string, funcs ...ModelEventFunc)
 		DoEvent(name string, document DocumentInterface) (err error)
-		DB(ctx context.Context) (c *mgo.Collection)
+		Validate(document DocumentInterface) (err error)
+		ValidateUpdate(update interface{}) (err error)
+		DoRelation(ctx context.Context, name string, query *Query) (err error)
+		DoHistory(ctx context.Context, action string, id interface{}, old interface{}) (err error)
+		Histories(ctx context.Context, id interface{}) (histories []History, err error)
+		HistoryAt(ctx context.Context, id interface{}, at time.Time, document interface{}) (err error)
+		HistoryVersion(ctx context.Context, id interface{}, version int, document interface{}) (err error)
+		DB(ctx context.Context) (c *mgo.Collection, err error)
+		DBContext(ctx context.Context) (c *mgo.Collection, release func(), err error)
 		Exists(ctx context.Context) (exists bool, err error)
 		Create(ctx context.Context) (err error)
 		Update(ctx context.Context) (updated []string, err error)
 		Drop(ctx context.Context) (err error)
 		Query(ctx context.Context) (query *Query)
+		DefaultScope(ctx context.Context) (filters []map[string]interface{}, err error)
+		Scope(name string) (scope ModelScope, ok bool)
+		ScopeList() (scopes []ModelScope)
 		DocumentStruct() DocumentStruct
 	}
 	Model struct {
@@ -29,9 +41,36 @@ type (
 		Document DocumentInterface
 		Indexs   []mgo.Index
 		Events   map[string][]ModelEventFunc
+		// Update 同步 index 的选项
+		IndexOptions IndexOptions
+		// 为空 使用全局 Validator
+		Validator ValidatorInterface
+		Relations []ModelRelation
+		// 行级过滤 Query.Unscoped() 不使用
+		DefaultScopes []ModelDefaultScope
+		// 命名过滤条件 Query.Scope(name)
+		Scopes map[string]ModelScope
+		// 写入历史记录到 <name>_history
+		History bool
+		// 根据 DocumentStruct 生成 $jsonSchema validator
+		Schema           bool
+		ValidationLevel  string
+		ValidationAction string
+		// 创建集合的选项
+		Collection ModelCollection
+		// 多租户 选择 数据库名 集合名
+		Tenant TenantResolver
+		// context 中没有 session 时使用
+		Session *mgo.Session
+		// 读偏好 写关注 读关注 默认值
+		SessionOptions SessionOptions
 	}
+
+	// ModelDefaultScope 每个查询都带上的过滤条件 返回 nil 不过滤 返回错误的 查询失败
+	ModelDefaultScope func(ctx context.Context) (filter map[string]interface{}, err error)
 )
 
+// Deprecated: 使用 WithSession 旧的 string key 仍然可以读取
 var CONTEXT = "mongo"
 
 func (model *Model) OnEvent(name string, funcs ...ModelEventFunc) {
@@ -66,27 +105,93 @@ func (model *Model) DoEvent(name string, document DocumentInterface) (err error)
 	return
 }
 
-func (model *Model) DB(ctx context.Context) (c *mgo.Collection) {
+func (model *Model) Validate(document DocumentInterface) (err error) {
+	validator := model.Validator
+	if validator == nil {
+		validator = Validator
+	}
+	if validator != nil {
+		if err = validator.ValidateDocument(document); err != nil {
+			return
+		}
+	}
+	if err = model.DoEvent("validate", document); err != nil {
+		return
+	}
+	return
+}
+
+// names 数据库名 和 集合名
+func (model *Model) names() (database string, collection string) {
 	names := strings.SplitN(model.Name, ".", 2)
 	if len(names) == 1 {
 		names = []string{"", names[0]}
 	}
-	c = ctx.Value(CONTEXT).(*mgo.Session).DB(names[0]).C(names[1])
+	return names[0], names[1]
+}
+
+// session context 中的 session 没有就用 model.Session
+func (model *Model) session(ctx context.Context) (session *mgo.Session, err error) {
+	var ok bool
+	if session, ok = SessionFrom(ctx); ok {
+		return
+	}
+	if model.Session != nil {
+		session = model.Session
+		return
+	}
+	err = ErrNoSession
+	return
+}
+
+// DB context 中的 session 的 collection 不克隆 不使用 SessionOptions
+func (model *Model) DB(ctx context.Context) (c *mgo.Collection, err error) {
+	var session *mgo.Session
+	if session, err = model.session(ctx); err != nil {
+		return
+	}
+	var database, collection string
+	if database, collection, err = model.tenantNames(ctx); err != nil {
+		return
+	}
+	c = session.DB(database).C(collection)
+	return
+}
+
+// DBContext 克隆 session 的 collection 使用 SessionOptions 和 context 中覆盖的选项
+// 用完必须调用 release 关闭克隆的 session
+func (model *Model) DBContext(ctx context.Context) (c *mgo.Collection, release func(), err error) {
+	var session *mgo.Session
+	if session, err = model.session(ctx); err != nil {
+		return
+	}
+	var database, collection string
+	if database, collection, err = model.tenantNames(ctx); err != nil {
+		return
+	}
+	session = session.Clone()
+	model.SessionOptions.merge(SessionOptionsFrom(ctx)).apply(session)
+	c = session.DB(database).C(collection)
+	release = session.Close
 	return
 }
 
 func (model *Model) Exists(ctx context.Context) (exists bool, err error) {
-	names := strings.SplitN(model.Name, ".", 2)
-	if len(names) == 1 {
-		names = []string{"", names[0]}
+	var session *mgo.Session
+	if session, err = model.session(ctx); err != nil {
+		return
+	}
+	var database, collection string
+	if database, collection, err = model.tenantNames(ctx); err != nil {
+		return
 	}
-	db := ctx.Value(CONTEXT).(*mgo.Session).DB(names[0])
+	db := session.DB(database)
 	var collectionNames []string
 	if collectionNames, err = db.CollectionNames(); err != nil {
 		return
 	}
 	for _, collectionName := range collectionNames {
-		if collectionName == names[1] {
+		if collectionName == collection {
 			exists = true
 			return
 		}
@@ -95,76 +200,88 @@ func (model *Model) Exists(ctx context.Context) (exists bool, err error) {
 }
 
 func (model *Model) Create(ctx context.Context) (err error) {
+	_, _, err = model.create(ctx)
+	return
+}
+
+// create 集合不存在的 创建后 Update 返回 Update 的结果
+func (model *Model) create(ctx context.Context) (created bool, updated []string, err error) {
 	var exists bool
 	if exists, err = model.Exists(ctx); err != nil || exists {
 		return
 	}
-	collection := model.DB(ctx)
-	if err = collection.Create(&mgo.CollectionInfo{}); err != nil {
+	var session *mgo.Session
+	if session, err = model.session(ctx); err != nil {
+		return
+	}
+	var database, collection string
+	if database, collection, err = model.tenantNames(ctx); err != nil {
 		return
 	}
-	if _, err = model.Update(ctx); err != nil {
+	if err = model.Collection.validate(); err != nil {
 		return
 	}
+	if err = session.DB(database).Run(model.createCommand(collection), nil); err != nil {
+		return
+	}
+	created = true
+	updated, err = model.Update(ctx)
 	return
 }
 
 func (model *Model) Update(ctx context.Context) (updated []string, err error) {
-	collection := model.DB(ctx)
-	indexMaps := map[string]mgo.Index{}
-	for _, index := range model.Indexs {
-		if index.Name == "" {
-			for _, field := range index.Key {
-				if index.Name != "" {
-					index.Name += "_"
-				}
-				field = strings.Replace(field, "@", "2d-", -1)
-				field = strings.Replace(field, ":", "-", -1)
-				field = strings.Replace(field, "$", "", -1)
-				field = strings.Replace(field, "+", "", -1)
-				index.Name += field
-			}
+	// 视图 没有 index
+	if model.Collection.ViewOn != "" {
+		return model.updateCollection(ctx)
+	}
+
+	var changes []IndexChange
+	if changes, err = model.SyncIndexes(ctx, model.IndexOptions); err != nil {
+		return
+	}
+	for _, change := range changes {
+		if change.Action == IndexDrop {
+			updated = append(updated, "del."+change.Name)
+		} else {
+			updated = append(updated, "set."+change.Name)
 		}
-		indexMaps[index.Name] = index
 	}
-	var oldIndexs []mgo.Index
-	oldIndexs, err = collection.Indexes()
-	if err != nil && !strings.HasSuffix(err.Error(), "doesn't exist") {
+
+	// 只返回 index 计划
+	if model.IndexOptions.DryRun {
 		return
 	}
-	err = nil
 
-	oldIndexMaps := map[string]mgo.Index{}
-	for _, index := range oldIndexs {
-		oldIndexMaps[index.Name] = index
+	// $jsonSchema
+	var schemaUpdated bool
+	if schemaUpdated, err = model.updateSchema(ctx); err != nil {
+		return
+	}
+	if schemaUpdated {
+		updated = append(updated, "set.$jsonSchema")
 	}
 
-	// 删除 旧的 index
-	for name, _ := range oldIndexMaps {
-		if _, ok := indexMaps[name]; !ok && name != "_id_" {
-			updated = append(updated, "del."+name)
-			if err = collection.DropIndexName(name); err != nil {
-				return
-			}
-		}
+	// 集合选项
+	var collectionUpdated []string
+	if collectionUpdated, err = model.updateCollection(ctx); err != nil {
+		return
 	}
+	updated = append(updated, collectionUpdated...)
 
-	// 设置新的 index
-	for name, index := range indexMaps {
-		if oldIndex, ok := oldIndexMaps[name]; ok && reflect.DeepEqual(oldIndex, index) {
-			continue
-		}
-		collection.DropIndexName(name)
-		if err = collection.EnsureIndex(index); err != nil {
-			return
-		}
-		updated = append(updated, "set."+name)
+	if err = model.updateHistory(ctx); err != nil {
+		return
 	}
 	return
 }
 
 func (model *Model) Drop(ctx context.Context) (err error) {
-	err = model.DB(ctx).DropCollection()
+	var collection *mgo.Collection
+	var release func()
+	if collection, release, err = model.DBContext(ctx); err != nil {
+		return
+	}
+	defer release()
+	err = collection.DropCollection()
 	return
 }
 
@@ -173,6 +290,20 @@ func (model *Model) Query(ctx context.Context) (query *Query) {
 	return
 }
 
+func (model *Model) DefaultScope(ctx context.Context) (filters []map[string]interface{}, err error) {
+	for _, scope := range model.DefaultScopes {
+		var filter map[string]interface{}
+		if filter, err = scope(ctx); err != nil {
+			filters = nil
+			return
+		}
+		if len(filter) != 0 {
+			filters = append(filters, filter)
+		}
+	}
+	return
+}
+
 func (model *Model) DocumentStruct() DocumentStruct {
 	documentStruct, err := DocumentStructParse(reflect.TypeOf(model.Document))
 	if err != nil {
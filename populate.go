@@ -1,31 +1,241 @@
 package model
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"reflect"
+	"sort"
 	"strings"
+	"sync"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
 )
 
 type (
-	Populate     map[string]*Query
+	Populate map[string]*Query
+	// reflectValue 需要填充的字段 map 的 key 和 对应的 id
 	reflectValue struct {
-		key    reflect.Value
-		parent reflect.Value
-		value  reflect.Value
+		key   reflect.Value
+		value reflect.Value
+		ids   []interface{}
+		// 多态 type 字段的值
+		kind string
+		// 所在 document 的序号
+		document int
 	}
 	reflectPath struct {
 		key   reflect.Value
 		index int
 	}
+	// reflectCountResult 计数聚合 每个 id 的数量
+	reflectCountResult struct {
+		ID bson.Raw `bson:"_id"`
+		N  int      `bson:"n"`
+	}
+
+	// PopulateReport 记录 id 不存在的 填充
+	PopulateReport struct {
+		mutex   sync.Mutex
+		Missing []PopulateMissing
+	}
+	PopulateMissing struct {
+		Path  string
+		Model string
+		IDs   []interface{}
+	}
+
+	// PopulateError 所有失败的路径 按路径排序
+	PopulateError struct {
+		Errors []PopulatePathError
+	}
+	PopulatePathError struct {
+		Path string
+		Err  error
+	}
+
+	populateJob struct {
+		path          string
+		populateField DocumentStructField
+		findValues    []reflectValue
+		query         *Query
+	}
+
+	// populateState 深度填充的 深度 和 每个 document 从根开始的路径
+	populateState struct {
+		depth       int
+		maxDepth    int
+		concurrency int
+		// 所有层级共用 最外层 AllContext 创建 nil 不限制
+		slots chan struct{}
+		// 和填充的 documents 顺序相同 包含 document 自己 根为 nil
+		paths []map[string]bool
+	}
+)
+
+// 填充时 id 不存在的处理
+const (
+	// 返回错误 默认
+	PopulateMissingError = "error"
+	// 忽略
+	PopulateMissingSkip = "skip"
+	// 设置零值 切片中保留位置
+	PopulateMissingNil = "nil"
+	// 忽略 并记录到 context 中的 PopulateReport
+	PopulateMissingReport = "report"
 )
 
+// 默认最大填充深度
+var PopulateMaxDepth = 5
+
+// 默认同时填充的路径数 包括所有层级
+var PopulateConcurrency = 4
+
+var populateStateContextKey = &contextKey{"populateState"}
+
+var populateReportContextKey = &contextKey{"populateReport"}
+
+// WithPopulateReport 记录 PopulateMissingReport 的不存在 id
+func WithPopulateReport(ctx context.Context) (context.Context, *PopulateReport) {
+	report := &PopulateReport{}
+	return context.WithValue(ctx, populateReportContextKey, report), report
+}
+
+func PopulateReportFrom(ctx context.Context) (report *PopulateReport, ok bool) {
+	report, ok = ctx.Value(populateReportContextKey).(*PopulateReport)
+	return
+}
+
+func (populateError *PopulateError) Error() string {
+	messages := make([]string, 0, len(populateError.Errors))
+	for _, pathError := range populateError.Errors {
+		messages = append(messages, pathError.Error())
+	}
+	return "populate: " + strings.Join(messages, "; ")
+}
+
+func (pathError PopulatePathError) Error() string {
+	return fmt.Sprintf("(%s) %s", pathError.Path, pathError.Err)
+}
+
+func (report *PopulateReport) add(missing PopulateMissing) {
+	report.mutex.Lock()
+	defer report.mutex.Unlock()
+	report.Missing = append(report.Missing, missing)
+}
+
+// WithPopulateDepth 设置最大填充深度
+func WithPopulateDepth(ctx context.Context, depth int) context.Context {
+	state := populateStateFrom(ctx)
+	state.maxDepth = depth
+	return context.WithValue(ctx, populateStateContextKey, state)
+}
+
+// WithPopulateConcurrency 设置同时填充的路径数 所有层级一起计算
+func WithPopulateConcurrency(ctx context.Context, concurrency int) context.Context {
+	state := populateStateFrom(ctx)
+	state.concurrency = concurrency
+	state.slots = nil
+	return context.WithValue(ctx, populateStateContextKey, state)
+}
+
+func populateStateFrom(ctx context.Context) (state populateState) {
+	var ok bool
+	if state, ok = ctx.Value(populateStateContextKey).(populateState); !ok {
+		state.maxDepth = PopulateMaxDepth
+		state.concurrency = PopulateConcurrency
+	}
+	return
+}
+
+// withSlots 创建所有层级共用的 slots 当前 goroutine 占一个
+func (state populateState) withSlots() populateState {
+	state.slots = make(chan struct{}, state.concurrency-1)
+	return state
+}
+
+// child 下一级 paths 和下一级的 documents 顺序相同
+func (state populateState) child(paths []map[string]bool) populateState {
+	state.depth++
+	state.paths = paths
+	return state
+}
+
+// path document 从根开始的路径
+func (state populateState) path(document int) map[string]bool {
+	if document < len(state.paths) {
+		return state.paths[document]
+	}
+	return nil
+}
+
+// childPaths 查询到的 document 的路径 引用它的所有父级路径的交集 加上自己的 key
+// key 为 nil 的 (reverse) 不知道自己的 key
+func (state populateState) childPaths(findValues []reflectValue, fetchIDs [][]interface{}, key func(id interface{}) string) (paths []map[string]bool) {
+	documents := map[interface{}][]int{}
+	for i, ids := range fetchIDs {
+		for _, id := range ids {
+			documents[id] = append(documents[id], i)
+		}
+	}
+	paths = make([]map[string]bool, len(fetchIDs))
+	seen := make([]bool, len(fetchIDs))
+	for _, findValue := range findValues {
+		parent := state.path(findValue.document)
+		for _, id := range findValue.ids {
+			for _, i := range documents[id] {
+				if !seen[i] {
+					seen[i] = true
+					paths[i] = make(map[string]bool, len(parent)+1)
+					for k := range parent {
+						paths[i][k] = true
+					}
+					continue
+				}
+				for k := range paths[i] {
+					if !parent[k] {
+						delete(paths[i], k)
+					}
+				}
+			}
+		}
+	}
+	if key != nil {
+		for i, ids := range fetchIDs {
+			if paths[i] == nil {
+				paths[i] = map[string]bool{}
+			}
+			for _, id := range ids {
+				paths[i][key(id)] = true
+			}
+		}
+	}
+	return
+}
+
+func populateVisitKey(typ reflect.Type, id interface{}) string {
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	return fmt.Sprintf("%s:%v", typ.String(), id)
+}
+
 func (populate Populate) One(document interface{}) (err error) {
-	documents := &[]interface{}{document}
-	return populate.All(documents)
+	return populate.OneContext(context.Background(), document)
 }
 
 func (populate Populate) All(documents interface{}) (err error) {
+	return populate.AllContext(context.Background(), documents)
+}
+
+func (populate Populate) OneContext(ctx context.Context, document interface{}) (err error) {
+	documents := &[]interface{}{document}
+	return populate.AllContext(ctx, documents)
+}
+
+// AllContext 填充 query 为 nil 的 从 DefaultRegistry 根据字段类型找 model
+func (populate Populate) AllContext(ctx context.Context, documents interface{}) (err error) {
 	documentsv := reflect.ValueOf(documents)
 
 	// 必须是指针
@@ -49,6 +259,15 @@ func (populate Populate) All(documents interface{}) (err error) {
 		return
 	}
 
+	// 超过最大深度
+	state := populateStateFrom(ctx)
+	if state.depth >= state.maxDepth {
+		return
+	}
+	if state.slots == nil && state.concurrency > 0 {
+		ctx = context.WithValue(ctx, populateStateContextKey, state.withSlots())
+	}
+
 	// 解析单个 document 格式
 	documentV := slicev.Index(0)
 	if documentV.Kind() == reflect.Interface {
@@ -59,113 +278,462 @@ func (populate Populate) All(documents interface{}) (err error) {
 		return
 	}
 
-	// 遍历填充
-	chans := make(chan error, len(populate))
-	for path, query := range populate {
-		findValue := map[interface{}][]reflectValue{}
+	// 先解析所有路径 出错时没有启动任何查询
+	paths := make([]string, 0, len(populate))
+	for path := range populate {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	var jobs []populateJob
+	for _, path := range paths {
+		query := populate[path]
+		var findValues []reflectValue
 		names := strings.Split(path, ".")
 		for i := 0; i < slicev.Len(); i++ {
 			documentV = slicev.Index(i)
 			if documentV.Kind() == reflect.Interface {
 				documentV = documentV.Elem()
 			}
-			if err = reflectFind(findValue, names, documentV, documentStruct); err != nil {
+			n := len(findValues)
+			if err = reflectFind(&findValues, names, documentV, documentStruct); err != nil {
 				return
 			}
+			for j := n; j < len(findValues); j++ {
+				findValues[j].document = i
+			}
 		}
-
-		if len(findValue) != 0 {
-			var findPath []string
-			if findPath, err = getFindPath(names, documentStruct); err != nil {
+		if len(findValues) == 0 {
+			continue
+		}
+		var populateField DocumentStructField
+		if populateField, err = getPopulateField(names, documentStruct); err != nil {
+			return
+		}
+		if query == nil {
+			if populateField.Populate.Discriminator != "" || populateField.Populate.DBRef {
+				// 多态 DBRef 每个 type 集合 从 registry 找
+				query = &Query{Context: ctx}
+			} else if query, err = registryQuery(ctx, names, populateField); err != nil {
 				return
 			}
-			// if err = reflectPopulate(findPath, findValue, query); err != nil {
-			// 	return
-			// }
-			// chans <- nil
-			go reflectPopulateChan(findPath, findValue, query, chans)
-		} else {
-			chans <- nil
 		}
+		jobs = append(jobs, populateJob{path: path, populateField: populateField, findValues: findValues, query: query})
 	}
 
-	for i := 0; i < len(populate); i++ {
-		val := <-chans
-		if err == nil && val != nil {
-			err = val
+	return populateRun(ctx, jobs)
+}
+
+// populateRun 填充 jobs 一个失败 或 ctx 取消后 不再开始新的
+func populateRun(parent context.Context, jobs []populateJob) (err error) {
+	if len(jobs) == 0 {
+		return
+	}
+	errs := populateEach(parent, len(jobs), func(ctx context.Context, i int) error {
+		job := jobs[i]
+		return reflectPopulate(ctx, job.path, job.populateField, job.findValues, job.query)
+	})
+
+	// 按路径排序 自己取消导致的错误不记录
+	var populateError PopulateError
+	for i, job := range jobs {
+		if errs[i] == nil || (errs[i] == context.Canceled && parent.Err() == nil) {
+			continue
 		}
+		populateError.Errors = append(populateError.Errors, PopulatePathError{Path: job.path, Err: errs[i]})
 	}
-	close(chans)
+	if len(populateError.Errors) != 0 {
+		err = &populateError
+		return
+	}
+	err = parent.Err()
 	return
 }
 
-func reflectPopulateChan(findPath []string, findValueMap map[interface{}][]reflectValue, query *Query, chans chan error) {
-	chans <- reflectPopulate(findPath, findValueMap, query)
+// populateEach 所有层级最多 concurrency 个同时运行 fn(0) ... fn(n-1) 没有空闲的 slot 在当前 goroutine 运行
+// 下一级不会等待上一级占用的 slot  一个失败后 取消 ctx 不再开始新的
+func populateEach(parent context.Context, n int, fn func(ctx context.Context, i int) error) (errs []error) {
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+
+	slots := populateStateFrom(ctx).slots
+	errs = make([]error, n)
+	run := func(i int) {
+		if errs[i] = fn(ctx, i); errs[i] != nil {
+			cancel()
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		if ctx.Err() != nil {
+			break
+		}
+		if slots == nil {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				run(i)
+			}(i)
+			continue
+		}
+		select {
+		case slots <- struct{}{}:
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				defer func() { <-slots }()
+				run(i)
+			}(i)
+		default:
+			run(i)
+		}
+	}
+	wg.Wait()
+	return
 }
 
-func reflectPopulate(findPath []string, findValueMap map[interface{}][]reflectValue, query *Query) (err error) {
+// reflectPopulate 查询 填充 findValues 每个父级的 sort limit skip 单独计算
+// reverse 的 id 是父级的 id 所有父级合并为一个 $in 查询
+func reflectPopulate(ctx context.Context, path string, populateField DocumentStructField, findValues []reflectValue, query *Query) (err error) {
+	// 数量 是否存在
+	if populateField.Populate.Count || populateField.Populate.Exists {
+		return reflectCount(strings.Split(populateField.Populate.Find, "."), findValues, query)
+	}
+
+	// 多态
+	if populateField.Populate.Discriminator != "" {
+		return reflectPolymorphic(ctx, path, populateField, findValues, query)
+	}
+
 	// 切片类型 切片 切片指针
-	var sliceTyp reflect.Type
-	var sliceVal reflect.Value
-	var slicePtr reflect.Value
-	for _, values := range findValueMap {
-		sliceTyp = values[0].value.Type()
-		if sliceTyp.Kind() == reflect.Slice {
-			sliceTyp = sliceTyp.Elem()
+	sliceTyp := findValues[0].value.Type()
+	if sliceTyp.Kind() == reflect.Slice || sliceTyp.Kind() == reflect.Map {
+		sliceTyp = sliceTyp.Elem()
+	}
+	if populateField.Populate.DBRef {
+		return reflectDBRef(ctx, path, findValues, query, sliceTyp)
+	}
+	return reflectPopulateType(ctx, path, populateField, findValues, query, sliceTyp)
+}
+
+// reflectPolymorphic 按 type 字段分组 每组用 query.Targets 或 registry 对应 model 的 document 类型填充
+func reflectPolymorphic(ctx context.Context, path string, populateField DocumentStructField, findValues []reflectValue, query *Query) (err error) {
+	var kinds []string
+	groups := map[string][]reflectValue{}
+	for _, findValue := range findValues {
+		if _, ok := groups[findValue.kind]; !ok {
+			kinds = append(kinds, findValue.kind)
 		}
-		sliceVal = reflect.MakeSlice(reflect.SliceOf(sliceTyp), 0, 0)
-		slicePtr = reflect.New(sliceVal.Type())
-		slicePtr.Elem().Set(sliceVal)
-		break
+		groups[findValue.kind] = append(groups[findValue.kind], findValue)
 	}
+	sort.Strings(kinds)
 
-	var findValue []interface{}
+	for _, kind := range kinds {
+		target, ok := polymorphicTarget(ctx, kind, query, DefaultRegistry)
+		if !ok {
+			// Targets 和 registry 都没有的 type 按 Missing 处理
+			var missing []interface{}
+			for _, findValue := range groups[kind] {
+				missing = append(missing, findValue.ids...)
+			}
+			missingQuery := *query
+			missingQuery.Options.Name = kind
+			if err = populateMissing(ctx, path, &missingQuery, missing); err != nil {
+				return
+			}
+			continue
+		}
+		model, ok := target.Model.(*Model)
+		if !ok || model.Document == nil {
+			err = fmt.Errorf("type (%s) model document not found", kind)
+			return
+		}
+		if err = reflectPopulateType(ctx, path, populateField, groups[kind], target, reflect.TypeOf(model.Document)); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// polymorphicTarget query.Targets 优先 没有的 从 registry 按 type 的值 (model 名 或 集合) 找
+func polymorphicTarget(ctx context.Context, kind string, query *Query, registry *Registry) (target *Query, ok bool) {
+	if target = query.Targets[kind]; target != nil {
+		ok = true
+		return
+	}
+	var model *Model
+	if model, ok = registry.Model(kind); !ok {
+		return
+	}
+	target = model.Query(ctx)
+	target.Options.Missing = query.Options.Missing
+	return
+}
+
+// reflectPopulateType 填充 sliceTyp 类型的 document
+func reflectPopulateType(ctx context.Context, path string, populateField DocumentStructField, findValues []reflectValue, query *Query, sliceTyp reflect.Type) (err error) {
+	findPath := strings.Split(populateField.Populate.Find, ".")
+	reverse := populateField.Populate.Reverse
+	sliceVal := reflect.MakeSlice(reflect.SliceOf(sliceTyp), 0, 0)
+
+	state := populateStateFrom(ctx)
+	var findIDs []interface{}
+	exists := map[interface{}]bool{}
 	existsValue := sliceVal
-	for key, values := range findValueMap {
-		var skip bool
-		for _, value := range values {
-			if reflectValueEmpty(value.value) {
+	var existsPaths []map[string]bool
+	// 值类型的 深度填充的是复制的 填充后写回
+	var existsSets []func(value reflect.Value)
+	writeBack := sliceTyp.Kind() == reflect.Struct
+	var emptyValues []reflectValue
+	for _, findValue := range findValues {
+		// 已经填充的 不再查询
+		value := findValue.value
+		if value.Kind() == reflect.Map {
+			value = value.MapIndex(findValue.key)
+		}
+		if !reflectValueEmpty(value) {
+			n := existsValue.Len()
+			if value.Kind() == reflect.Slice {
+				for i := 0; i < value.Len(); i++ {
+					m := existsValue.Len()
+					if existsValue = reflectAppendType(existsValue, value.Index(i), sliceTyp); writeBack && existsValue.Len() != m {
+						existsSets = append(existsSets, value.Index(i).Set)
+					}
+				}
+			} else if existsValue = reflectAppendType(existsValue, value, sliceTyp); writeBack && existsValue.Len() != n {
+				if findValue.value.Kind() == reflect.Map {
+					field, key := findValue.value, findValue.key
+					existsSets = append(existsSets, func(value reflect.Value) {
+						field.SetMapIndex(key, value)
+					})
+				} else {
+					existsSets = append(existsSets, findValue.value.Set)
+				}
+			}
+			for i := n; i < existsValue.Len(); i++ {
+				existsPaths = append(existsPaths, state.path(findValue.document))
+			}
+			continue
+		}
+
+		// 循环引用 这个 document 的上级 (从根开始的路径) 中已经有的 不再填充
+		parent := state.path(findValue.document)
+		ids := findValue.ids
+		findValue.ids = nil
+		for _, id := range ids {
+			if !reverse && parent[populateVisitKey(sliceTyp, id)] {
 				continue
 			}
-			if value.value.Type() == sliceTyp {
-				existsValue = reflect.Append(existsValue, value.value)
-				skip = true
-				break
+			findValue.ids = append(findValue.ids, id)
+			if !exists[id] {
+				exists[id] = true
+				findIDs = append(findIDs, id)
 			}
-			if value.value.Kind() == reflect.Slice && value.value.Type().Elem() == sliceTyp {
-				for i := 0; i < value.value.Len(); i++ {
-					existsValue = reflect.Append(existsValue, value.value.Index(i))
-				}
+		}
+		if len(findValue.ids) != 0 {
+			emptyValues = append(emptyValues, findValue)
+		}
+	}
+
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	var fetchValue reflect.Value
+	var fetchIDs [][]interface{}
+	var key func(id interface{}) string
+	n := existsValue.Len()
+	if len(findIDs) != 0 {
+		if fetchValue, fetchIDs, err = populateFetch(ctx, findPath, findIDs, sliceTyp, query); err != nil {
+			return
+		}
+		// reverse 的 id 不是目标的 id
+		if !reverse {
+			key = func(id interface{}) string {
+				return populateVisitKey(sliceTyp, id)
 			}
 		}
-		if skip {
-			continue
+		existsValue = reflect.AppendSlice(existsValue, fetchValue)
+		existsPaths = append(existsPaths, state.childPaths(emptyValues, fetchIDs, key)...)
+	}
+
+	// 深度填充 已存在的 和 查询到的  先填充 再赋值给父级
+	if query.Populate != nil && existsValue.Len() != 0 {
+		slicePtr := reflect.New(existsValue.Type())
+		slicePtr.Elem().Set(existsValue)
+		if err = query.Populate.AllContext(context.WithValue(ctx, populateStateContextKey, state.child(existsPaths)), slicePtr.Interface()); err != nil {
+			return
+		}
+		existsValue = slicePtr.Elem()
+		for i, set := range existsSets {
+			set(existsValue.Index(i))
+		}
+		if fetchValue.IsValid() {
+			fetchValue = existsValue.Slice(n, existsValue.Len())
 		}
-		findValue = append(findValue, key)
 	}
 
-	// 已存在的
-	if existsValue.Len() != 0 {
-		if query.Populate != nil {
-			slicePtr.Elem().Set(existsValue)
-			query.Populate.All(slicePtr.Interface())
+	if len(findIDs) != 0 {
+		// reverse 没有子级 不算不存在
+		var missing []interface{}
+		if reverse {
+			reflectAssign(emptyValues, fetchValue, fetchIDs, query, nil)
+		} else {
+			missing = reflectAssign(emptyValues, fetchValue, fetchIDs, query, exists)
 		}
-		return
+		err = populateMissing(ctx, path, query, missing)
 	}
+	return
+}
 
-	if len(findValue) == 0 {
+// populateMissing 按 query.Options.Missing 处理不存在的 id
+func populateMissing(ctx context.Context, path string, query *Query, missing []interface{}) (err error) {
+	if len(missing) == 0 {
 		return
 	}
+	switch query.Options.Missing {
+	case PopulateMissingSkip, PopulateMissingNil:
+	case PopulateMissingReport:
+		if report, ok := PopulateReportFrom(ctx); ok {
+			report.add(PopulateMissing{Path: path, Model: query.Options.Name, IDs: missing})
+		}
+	default:
+		err = fmt.Errorf("id not exists %v", missing)
+	}
+	return
+}
+
+// reflectAppendType 类型相同的 才添加 interface 的取实际值
+func reflectAppendType(slice reflect.Value, value reflect.Value, typ reflect.Type) reflect.Value {
+	if value.Kind() == reflect.Interface {
+		value = value.Elem()
+	}
+	if value.IsValid() && value.Type() == typ {
+		slice = reflect.Append(slice, value)
+	}
+	return slice
+}
 
-	findReflectPath := []reflectPath{}
+// reflectFetch 用 $in 查询 返回 document 和 每个 document 的 findPath 值
+func reflectFetch(findPath []string, findIDs []interface{}, sliceTyp reflect.Type, query *Query) (sliceVal reflect.Value, fetchIDs [][]interface{}, err error) {
+	var name string
+	var findReflectPath []reflectPath
+	var documentStruct DocumentStruct
 	if sliceTyp.Kind() == reflect.Struct || (sliceTyp.Kind() == reflect.Ptr && sliceTyp.Elem().Kind() == reflect.Struct) {
-		var documentStruct DocumentStruct
 		if documentStruct, err = DocumentStructParse(sliceTyp); err != nil {
 			return
 		}
+	}
+	var field DocumentStructField
+	if name, findReflectPath, field, err = populateFindPath(findPath, documentStruct); err != nil {
+		return
+	}
+
+	sliceVal = reflect.MakeSlice(reflect.SliceOf(sliceTyp), 0, 0)
+	slicePtr := reflect.New(sliceVal.Type())
+	slicePtr.Elem().Set(sliceVal)
+
+	// 不深度填充 由 reflectPopulate 处理 skip limit 每个父级单独计算
+	q := query.Clone()
+	q.Populate = nil
+	q.Options.Skip = 0
+	q.Options.Limit = 0
+	q.Options.Fields = populateFields(query.Options.Fields, name)
+
+	// 有 limit 的 每个 id 只取前 skip+limit 个
+	if query.Options.Limit > 0 {
+		return reflectFetchLimit(name, field.Type, findIDs, sliceTyp, q, query.Options.Skip+query.Options.Limit)
+	}
+
+	if err = q.In(name, findIDs).All(slicePtr.Interface()); err != nil {
+		return
+	}
+
+	sliceVal = slicePtr.Elem()
+	for i := 0; i < sliceVal.Len(); i++ {
+		fetchIDs = append(fetchIDs, reflectIDs(sliceVal.Index(i), findReflectPath))
+	}
+	return
+}
+
+// reflectFetchLimit 聚合查询 按 name 的每个 id 分组 每组最多 n 个  fetchIDs 是分组的 id
+// 一个 document 属于多个 id 的 每组一份
+func reflectFetchLimit(name string, keyTyp reflect.Type, findIDs []interface{}, sliceTyp reflect.Type, query *Query, n int) (sliceVal reflect.Value, fetchIDs [][]interface{}, err error) {
+	var match bson.M
+	if match, err = query.In(name, findIDs).Map(); err != nil {
+		return
+	}
+	var collection *mgo.Collection
+	var release func()
+	if collection, release, err = query.Model.DBContext(query.Context); err != nil {
+		return
+	}
+	defer release()
+
+	var results []struct {
+		Key      bson.Raw `bson:"_id"`
+		Document bson.Raw `bson:"document"`
+	}
+	if err = collection.Pipe(reflectFetchPipeline(name, match, findIDs, query.Options.Fields, query.Options.Sort, n)).AllowDiskUse().All(&results); err != nil {
+		return
+	}
+
+	// 分组的 id 解码为字段的类型 和 父级的 id 比较
+	keyTyp = reflectKeyType(keyTyp)
+	sliceVal = reflect.MakeSlice(reflect.SliceOf(sliceTyp), 0, len(results))
+	for _, result := range results {
+		key := reflect.New(keyTyp)
+		if err = result.Key.Unmarshal(key.Interface()); err != nil {
+			return
+		}
+		value := reflect.New(sliceTyp)
+		if err = result.Document.Unmarshal(value.Interface()); err != nil {
+			return
+		}
+		sliceVal = reflect.Append(sliceVal, value.Elem())
+		fetchIDs = append(fetchIDs, []interface{}{key.Elem().Interface()})
+	}
+	return
+}
+
+// reflectFetchPipeline $match → 按 id $group 用 $topN ($firstN) 每组只保留前 n 个 → 展开 再排序
+// 不用 $push 再 $slice 子级很多时 $push 会把整组放进内存
+func reflectFetchPipeline(name string, match bson.M, findIDs []interface{}, fields map[string]interface{}, sort []string, n int) (pipeline []bson.M) {
+	pipeline = []bson.M{{"$match": match}}
+	if len(fields) != 0 {
+		pipeline = append(pipeline, bson.M{"$project": fields})
+	}
+	// 数组字段 每个元素一组
+	pipeline = append(pipeline,
+		bson.M{"$project": bson.M{"key": "$" + name, "document": "$$ROOT"}},
+		bson.M{"$unwind": "$key"},
+		bson.M{"$match": bson.M{"key": bson.M{"$in": findIDs}}},
+	)
+	var documentSort bson.D
+	for _, elem := range lookupSort(sort) {
+		documentSort = append(documentSort, bson.DocElem{Name: "document." + elem.Name, Value: elem.Value})
+	}
+	documents := bson.M{"$firstN": bson.M{"input": "$document", "n": n}}
+	if len(documentSort) != 0 {
+		documents = bson.M{"$topN": bson.M{"n": n, "sortBy": documentSort, "output": "$document"}}
+	}
+	pipeline = append(pipeline,
+		bson.M{"$group": bson.M{"_id": "$key", "documents": documents}},
+		bson.M{"$unwind": "$documents"},
+		bson.M{"$project": bson.M{"document": "$documents"}},
+	)
+	if len(documentSort) != 0 {
+		pipeline = append(pipeline, bson.M{"$sort": documentSort})
+	}
+	return
+}
+
+// populateFindPath 目标结构体的 bson 路径 和 最后一个字段 documentStruct 为 nil 时原样使用
+func populateFindPath(findPath []string, documentStruct DocumentStruct) (name string, findReflectPath []reflectPath, field DocumentStructField, err error) {
+	findPath = append([]string{}, findPath...)
+	if documentStruct != nil {
 		for i, key := range findPath {
-			field, ok := documentStruct[key]
-			if !ok {
+			var ok bool
+			if field, ok = documentStruct[key]; !ok {
 				err = fmt.Errorf("Path not found {%s}", findPath)
 				return
 			}
@@ -183,122 +751,283 @@ func reflectPopulate(findPath []string, findValueMap map[interface{}][]reflectVa
 			findReflectPath = append(findReflectPath, reflectPath{key: reflect.ValueOf(val), index: 0})
 		}
 	}
+	name = strings.Join(findPath, ".")
+	return
+}
 
-	sliceVal = reflect.MakeSlice(reflect.SliceOf(sliceTyp), 0, 0)
-	slicePtr.Elem().Set(sliceVal)
-	query.In(strings.Join(findPath, "."), findValue).All(slicePtr.Interface())
+// reflectCount 用 $group 统计 填充数量 或 是否存在 默认不统计软删除的
+func reflectCount(findPath []string, findValues []reflectValue, query *Query) (err error) {
+	exists := map[interface{}]bool{}
+	var findIDs []interface{}
+	for _, findValue := range findValues {
+		for _, id := range findValue.ids {
+			if !exists[id] {
+				exists[id] = true
+				findIDs = append(findIDs, id)
+			}
+		}
+	}
 
-	sliceVal = slicePtr.Elem()
-	for i := 0; i < sliceVal.Len(); i++ {
-		field := sliceVal.Index(i)
-		if err = reflectSet(field, field, findReflectPath, findValueMap); err != nil {
+	var name string
+	var field DocumentStructField
+	if name, _, field, err = populateFindPath(findPath, query.Model.DocumentStruct()); err != nil {
+		return
+	}
+	q := query.Clone()
+	if q.Options.Trash == 0 {
+		q.Options.Trash = -1
+	}
+	var match bson.M
+	if match, err = q.In(name, findIDs).Map(); err != nil {
+		return
+	}
+	pipeline := []bson.M{{"$match": match}}
+	if field.Type != nil && field.Type.Kind() == reflect.Slice {
+		pipeline = append(pipeline, bson.M{"$unwind": "$" + name})
+	}
+	pipeline = append(pipeline, bson.M{"$group": bson.M{"_id": "$" + name, "n": bson.M{"$sum": 1}}})
+
+	var collection *mgo.Collection
+	var release func()
+	if collection, release, err = q.Model.DBContext(q.Context); err != nil {
+		return
+	}
+	defer release()
+	var results []reflectCountResult
+	if err = collection.Pipe(pipeline).All(&results); err != nil {
+		return
+	}
+	var counts map[interface{}]int
+	if counts, err = reflectCounts(reflectKeyType(field.Type), results); err != nil {
+		return
+	}
+
+	for _, findValue := range findValues {
+		var n int
+		for _, id := range findValue.ids {
+			n += counts[id]
+		}
+		value := findValue.value
+		typ := value.Type()
+		if value.Kind() == reflect.Map {
+			typ = typ.Elem()
+		}
+		var val reflect.Value
+		switch typ.Kind() {
+		case reflect.Bool:
+			val = reflect.ValueOf(n != 0).Convert(typ)
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			val = reflect.ValueOf(n).Convert(typ)
+		default:
+			err = fmt.Errorf("populate: count not int, bool %s", typ.Kind().String())
 			return
 		}
+		if value.Kind() == reflect.Map {
+			value.SetMapIndex(findValue.key, val)
+		} else {
+			value.Set(val)
+		}
 	}
 	return
 }
 
-func reflectSet(value reflect.Value, field reflect.Value, fieldPath []reflectPath, findValueMap map[interface{}][]reflectValue) (err error) {
-	if field.Kind() == reflect.Ptr {
-		field = value.Elem()
+// reflectCounts 分组的 id 解码为字段的类型 和 reflectAssign 一样 按父级的 id 比较
+func reflectCounts(keyTyp reflect.Type, results []reflectCountResult) (counts map[interface{}]int, err error) {
+	counts = map[interface{}]int{}
+	for _, result := range results {
+		key := reflect.New(keyTyp)
+		if err = result.ID.Unmarshal(key.Interface()); err != nil {
+			return
+		}
+		counts[key.Elem().Interface()] += result.N
 	}
-	path := fieldPath[0]
-	if len(fieldPath) != 1 {
-		switch field.Kind() {
-		case reflect.Slice:
-			for i := 0; i < field.Len(); i++ {
-				if err = reflectSet(value, field.Index(i), fieldPath, findValueMap); err != nil {
-					return
+	return
+}
+
+// reflectKeyType 字段储存的 id 的类型 指针 和 数组 (除了 []byte) 取元素 没有的用 interface{}
+func reflectKeyType(typ reflect.Type) reflect.Type {
+	for typ != nil && (typ.Kind() == reflect.Ptr || (typ.Kind() == reflect.Slice && typ.Elem().Kind() != reflect.Uint8)) {
+		typ = typ.Elem()
+	}
+	if typ == nil {
+		typ = reflect.TypeOf((*interface{})(nil)).Elem()
+	}
+	return typ
+}
+
+// reflectAssign 填充到每个父级 有 sort 的按查询结果顺序 否则按 id 顺序
+// 返回 fetched 中查询了 但是不存在的 id  PopulateMissingNil 时 不存在的是 -1 填充零值
+func reflectAssign(findValues []reflectValue, fetchValue reflect.Value, fetchIDs [][]interface{}, query *Query, fetched map[interface{}]bool) (missing []interface{}) {
+	documents := map[interface{}][]int{}
+	for i, ids := range fetchIDs {
+		for _, id := range ids {
+			documents[id] = append(documents[id], i)
+		}
+	}
+
+	missingNil := query.Options.Missing == PopulateMissingNil
+	missings := map[interface{}]bool{}
+	for _, findValue := range findValues {
+		var indexs []int
+		for _, id := range findValue.ids {
+			if _, ok := documents[id]; !ok && fetched[id] {
+				if !missings[id] {
+					missings[id] = true
+					missing = append(missing, id)
+				}
+				if missingNil {
+					indexs = append(indexs, -1)
 				}
+				continue
 			}
-		case reflect.Map:
-			field := field.MapIndex(path.key)
-			if !field.IsValid() {
-				err = fmt.Errorf("populate not key %v", path.key.Interface())
-				return
+			indexs = append(indexs, documents[id]...)
+		}
+		if len(query.Options.Sort) != 0 {
+			sort.Ints(indexs)
+			// 零值 放到最后
+			n := 0
+			for n < len(indexs) && indexs[n] == -1 {
+				n++
 			}
-			if err = reflectSet(value, field, fieldPath[1:], findValueMap); err != nil {
-				return
+			indexs = append(indexs[n:len(indexs):len(indexs)], indexs[:n]...)
+		}
+
+		switch findValue.value.Kind() {
+		case reflect.Slice:
+			// 每个父级的 skip limit
+			if query.Options.Skip > 0 {
+				if query.Options.Skip >= len(indexs) {
+					indexs = nil
+				} else {
+					indexs = indexs[query.Options.Skip:]
+				}
 			}
-		case reflect.Struct:
-			field := field.Field(path.index)
-			if !field.IsValid() {
-				err = fmt.Errorf("populate not key %v", path.key.Interface())
-				return
+			if query.Options.Limit > 0 && len(indexs) > query.Options.Limit {
+				indexs = indexs[:query.Options.Limit]
 			}
-			if err = reflectSet(value, field, fieldPath[1:], findValueMap); err != nil {
-				return
+			value := reflect.MakeSlice(findValue.value.Type(), 0, len(indexs))
+			for _, i := range indexs {
+				value = reflect.Append(value, reflectFetchIndex(fetchValue, i))
 			}
-		default:
-			err = fmt.Errorf("populate not key %v", path.key.Interface())
-			return
-		}
-	} else {
-		var idv reflect.Value
-		switch field.Kind() {
+			findValue.value.Set(value)
 		case reflect.Map:
-			idv = field.MapIndex(path.key)
-		case reflect.Struct:
-			idv = field.Field(path.index)
+			if len(indexs) != 0 {
+				findValue.value.SetMapIndex(findValue.key, reflectFetchIndex(fetchValue, indexs[0]))
+			}
 		default:
-			err = fmt.Errorf("populate not struct, map %s", field.Type().Kind().String())
-			return
-		}
-		if !idv.IsValid() {
-			err = fmt.Errorf("populate not key %v", path.key)
-		}
-		if idv.Kind() == reflect.Ptr {
-			idv = idv.Elem()
-		}
-		ids := []interface{}{}
-		if idv.Kind() == reflect.Slice {
-			for i := 0; i < field.Len(); i++ {
-				ids = append(ids, field.Index(i).Interface())
+			if len(indexs) != 0 {
+				findValue.value.Set(reflectFetchIndex(fetchValue, indexs[0]))
 			}
-		} else {
-			ids = append(ids, idv.Interface())
 		}
-		var inc int
-		for _, id := range ids {
-			if findValues, ok := findValueMap[id]; ok {
-				for _, findValue := range findValues {
-					switch findValue.value.Kind() {
-					case reflect.Ptr:
-						findValue.value.Set(value)
-					case reflect.Map:
-						findValue.value.SetMapIndex(findValue.key, value)
-					case reflect.Slice:
-						findValue.value.Set(reflect.Append(findValue.value, value))
-					default:
-						findValue.value.Set(value)
-					}
-				}
-				inc++
-			}
+	}
+	return
+}
+
+// reflectFetchIndex -1 返回零值
+func reflectFetchIndex(fetchValue reflect.Value, i int) reflect.Value {
+	if i == -1 {
+		return reflect.Zero(fetchValue.Type().Elem())
+	}
+	return fetchValue.Index(i)
+}
+
+// reflectIDs document 中 findPath 的值 切片的 每个元素
+func reflectIDs(field reflect.Value, fieldPath []reflectPath) (ids []interface{}) {
+	for field.Kind() == reflect.Ptr || field.Kind() == reflect.Interface {
+		field = field.Elem()
+	}
+	if !field.IsValid() {
+		return
+	}
+	path := fieldPath[0]
+	switch field.Kind() {
+	case reflect.Slice:
+		for i := 0; i < field.Len(); i++ {
+			ids = append(ids, reflectIDs(field.Index(i), fieldPath)...)
 		}
-		if inc == 0 {
-			err = fmt.Errorf("populate id not exists %v", ids)
-			return
+		return
+	case reflect.Map:
+		field = field.MapIndex(path.key)
+	case reflect.Struct:
+		field = field.Field(path.index)
+	default:
+		return
+	}
+	if len(fieldPath) != 1 {
+		return reflectIDs(field, fieldPath[1:])
+	}
+
+	for field.Kind() == reflect.Ptr || field.Kind() == reflect.Interface {
+		field = field.Elem()
+	}
+	if !field.IsValid() {
+		return
+	}
+	if field.Kind() == reflect.Slice {
+		for i := 0; i < field.Len(); i++ {
+			ids = append(ids, field.Index(i).Interface())
 		}
+	} else {
+		ids = append(ids, field.Interface())
 	}
 	return
 }
 
-func getFindPath(names []string, documentStruct DocumentStruct) (findPath []string, err error) {
-	var documentStructField DocumentStructField
+// populateFields 包含模式的 加上 findPath 排除模式的 去掉 findPath
+func populateFields(fields map[string]interface{}, name string) map[string]interface{} {
+	if len(fields) == 0 {
+		return fields
+	}
+	var include bool
+	for key, val := range fields {
+		if key == "_id" {
+			continue
+		}
+		switch val {
+		case 0, false:
+		default:
+			include = true
+		}
+	}
+	values := make(map[string]interface{}, len(fields)+1)
+	for key, val := range fields {
+		values[key] = val
+	}
+	if include {
+		values[name] = 1
+	} else {
+		delete(values, name)
+	}
+	return values
+}
+
+func getPopulateField(names []string, documentStruct DocumentStruct) (documentStructField DocumentStructField, err error) {
 	for _, name := range names {
 		if documentStruct == nil {
-			err = fmt.Errorf("populate: getFindPath (%v)", names)
+			err = fmt.Errorf("populate: getPopulateField (%v)", names)
 			return
 		}
 		documentStructField = documentStruct[name]
 		documentStruct = documentStructField.Children
 	}
-	findPath = strings.Split(documentStructField.Populate.Find, ".")
 	return
 }
 
-func reflectFind(maps map[interface{}][]reflectValue, path []string, value reflect.Value, valueStruct DocumentStruct) (err error) {
+func registryQuery(ctx context.Context, names []string, documentStructField DocumentStructField) (query *Query, err error) {
+	if documentStructField.Type == nil {
+		err = fmt.Errorf("populate: registryQuery (%v)", names)
+		return
+	}
+	model, ok := DefaultRegistry.ModelByType(documentStructField.Type)
+	if !ok {
+		err = fmt.Errorf("populate: path (%s) model not found", strings.Join(names, "."))
+		return
+	}
+	query = model.Query(ctx)
+	return
+}
+
+func reflectFind(findValues *[]reflectValue, path []string, value reflect.Value, valueStruct DocumentStruct) (err error) {
 	name := path[0]
 
 	if value.Kind() == reflect.Ptr {
@@ -325,18 +1054,18 @@ func reflectFind(maps map[interface{}][]reflectValue, path []string, value refle
 		switch field.Kind() {
 		case reflect.Map:
 			for _, key := range field.MapKeys() {
-				if err = reflectFind(maps, fieldPath, field.MapIndex(key), fieldStruct.Children); err != nil {
+				if err = reflectFind(findValues, fieldPath, field.MapIndex(key), fieldStruct.Children); err != nil {
 					return
 				}
 			}
 		case reflect.Slice:
 			for i := 0; i < field.Len(); i++ {
-				if err = reflectFind(maps, fieldPath, field.Index(i), fieldStruct.Children); err != nil {
+				if err = reflectFind(findValues, fieldPath, field.Index(i), fieldStruct.Children); err != nil {
 					return
 				}
 			}
 		default:
-			if err = reflectFind(maps, fieldPath, field, fieldStruct.Children); err != nil {
+			if err = reflectFind(findValues, fieldPath, field, fieldStruct.Children); err != nil {
 				return
 			}
 		}
@@ -355,24 +1084,36 @@ func reflectFind(maps map[interface{}][]reflectValue, path []string, value refle
 			return
 		}
 
+		// 多态 没有 type 的不填充
+		var kind string
+		if fieldStruct.Populate.Discriminator != "" {
+			if kind = value.Field(fieldStruct.Populate.DiscriminatorIndex).String(); kind == "" {
+				return
+			}
+		}
+
 		switch idValue.Kind() {
 		case reflect.Map:
+			if field.Kind() == reflect.Map && field.IsNil() {
+				field.Set(reflect.MakeMap(field.Type()))
+			}
 			for _, key := range idValue.MapKeys() {
 				if val := idValue.MapIndex(key); !reflectValueEmpty(val) {
-					id := val.Interface()
-					maps[id] = append(maps[id], reflectValue{key: key, value: field})
+					*findValues = append(*findValues, reflectValue{key: key, value: field, ids: []interface{}{val.Interface()}, kind: kind})
 				}
 			}
 		case reflect.Slice:
+			findValue := reflectValue{value: field, kind: kind}
 			for i := 0; i < idValue.Len(); i++ {
 				if val := idValue.Index(i); !reflectValueEmpty(val) {
-					id := val.Interface()
-					maps[id] = append(maps[id], reflectValue{value: field})
+					findValue.ids = append(findValue.ids, val.Interface())
 				}
 			}
+			if len(findValue.ids) != 0 {
+				*findValues = append(*findValues, findValue)
+			}
 		default:
-			id := idValue.Interface()
-			maps[id] = append(maps[id], reflectValue{value: field})
+			*findValues = append(*findValues, reflectValue{value: field, ids: []interface{}{idValue.Interface()}, kind: kind})
 		}
 	}
 	return
@@ -383,12 +1124,17 @@ func reflectValueEmpty(value reflect.Value) bool {
 		return true
 	}
 	switch value.Kind() {
-	case reflect.Ptr, reflect.Map, reflect.Slice:
+	case reflect.Ptr, reflect.Map, reflect.Slice, reflect.Interface:
 		return value.IsNil()
 	case reflect.String:
 		return value.String() == ""
 	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
 		return value.Int() == 0
+	case reflect.Struct:
+		if value.Type() == dbRefType {
+			return value.Interface().(mgo.DBRef).Id == nil
+		}
+		return true
 	default:
 		return true
 	}
@@ -0,0 +1,399 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+type populateTestChild struct {
+	ID int `bson:"_id"`
+}
+
+func TestReflectAssign(t *testing.T) {
+	children := []populateTestChild{{ID: 1}, {ID: 2}, {ID: 3}}
+	fetchIDs := [][]interface{}{{1}, {2}, {3}}
+	fetched := map[interface{}]bool{1: true, 2: true, 3: true, 4: true}
+
+	tests := []struct {
+		name    string
+		ids     []interface{}
+		options QueryOptions
+		want    []int
+		missing []interface{}
+	}{
+		{name: "id order", ids: []interface{}{3, 1, 2}, want: []int{3, 1, 2}},
+		{name: "sort order", ids: []interface{}{3, 1, 2}, options: QueryOptions{Sort: []string{"name"}}, want: []int{1, 2, 3}},
+		{name: "skip limit", ids: []interface{}{3, 1, 2}, options: QueryOptions{Skip: 1, Limit: 1}, want: []int{1}},
+		{name: "skip all", ids: []interface{}{3}, options: QueryOptions{Skip: 1}, want: []int{}},
+		{name: "missing", ids: []interface{}{4, 1}, want: []int{1}, missing: []interface{}{4}},
+		{name: "missing nil", ids: []interface{}{4, 1}, options: QueryOptions{Missing: PopulateMissingNil}, want: []int{0, 1}, missing: []interface{}{4}},
+		{name: "missing nil sort", ids: []interface{}{4, 2, 1}, options: QueryOptions{Missing: PopulateMissingNil, Sort: []string{"name"}}, want: []int{1, 2, 0}, missing: []interface{}{4}},
+		{name: "not fetched", ids: []interface{}{5, 2}, want: []int{2}},
+	}
+	for _, test := range tests {
+		var parent struct {
+			Children []populateTestChild
+		}
+		findValues := []reflectValue{{value: reflect.ValueOf(&parent).Elem().Field(0), ids: test.ids}}
+		missing := reflectAssign(findValues, reflect.ValueOf(children), fetchIDs, &Query{Options: test.options}, fetched)
+		got := []int{}
+		for _, child := range parent.Children {
+			got = append(got, child.ID)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: children = %v, want %v", test.name, got, test.want)
+		}
+		if !reflect.DeepEqual(missing, test.missing) {
+			t.Errorf("%s: missing = %v, want %v", test.name, missing, test.missing)
+		}
+	}
+
+	// 单个 和 map 的 只取第一个
+	var parent struct {
+		Child    *populateTestChild
+		Children map[string]populateTestChild
+	}
+	parent.Children = map[string]populateTestChild{}
+	ptrs := []*populateTestChild{&children[0], &children[1]}
+	parentv := reflect.ValueOf(&parent).Elem()
+	reflectAssign([]reflectValue{{value: parentv.Field(0), ids: []interface{}{2}}}, reflect.ValueOf(ptrs), fetchIDs[:2], &Query{}, fetched)
+	if parent.Child == nil || parent.Child.ID != 2 {
+		t.Errorf("ptr: child = %v", parent.Child)
+	}
+	reflectAssign([]reflectValue{{value: parentv.Field(1), key: reflect.ValueOf("a"), ids: []interface{}{1}}}, reflect.ValueOf(children), fetchIDs, &Query{}, fetched)
+	if parent.Children["a"].ID != 1 {
+		t.Errorf("map: children = %v", parent.Children)
+	}
+}
+
+func TestPopulateStatePaths(t *testing.T) {
+	typ := reflect.TypeOf(populateTestChild{})
+	key := func(id interface{}) string {
+		return populateVisitKey(typ, id)
+	}
+	cycle := func(state populateState, document int, id interface{}) bool {
+		return state.path(document)[key(id)]
+	}
+
+	// 根 X 的 Friends [A, B]  A 和 B 互相引用
+	root := populateStateFrom(context.Background())
+	level1 := root.child(root.childPaths([]reflectValue{{document: 0, ids: []interface{}{"A", "B"}}}, [][]interface{}{{"A"}, {"B"}}, key))
+
+	// 兄弟不是循环引用
+	if cycle(level1, 0, "B") || cycle(level1, 1, "A") {
+		t.Fatalf("siblings treated as cycle: %v", level1.paths)
+	}
+
+	// A.Friend = B  B.Friend = A
+	level2 := level1.child(level1.childPaths([]reflectValue{{document: 0, ids: []interface{}{"B"}}, {document: 1, ids: []interface{}{"A"}}}, [][]interface{}{{"B"}, {"A"}}, key))
+	// X -> A -> B -> A 是循环引用
+	if !cycle(level2, 0, "A") || !cycle(level2, 1, "B") {
+		t.Errorf("cycle not detected: %v", level2.paths)
+	}
+	if cycle(level2, 0, "C") {
+		t.Errorf("C treated as cycle: %v", level2.paths)
+	}
+
+	// 多个父级引用同一个 document 路径取交集
+	paths := level1.childPaths([]reflectValue{{document: 0, ids: []interface{}{"C"}}, {document: 1, ids: []interface{}{"C"}}}, [][]interface{}{{"C"}}, key)
+	if want := map[string]bool{key("C"): true}; !reflect.DeepEqual(paths[0], want) {
+		t.Errorf("paths = %v, want %v", paths[0], want)
+	}
+
+	// reverse 不知道自己的 key
+	paths = level1.childPaths([]reflectValue{{document: 0, ids: []interface{}{"A"}}}, [][]interface{}{{"A"}}, nil)
+	if want := map[string]bool{key("A"): true}; !reflect.DeepEqual(paths[0], want) {
+		t.Errorf("reverse paths = %v, want %v", paths[0], want)
+	}
+}
+
+func TestReflectCounts(t *testing.T) {
+	results := func(values ...bson.M) (results []reflectCountResult) {
+		for _, value := range values {
+			data, err := bson.Marshal(value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var result reflectCountResult
+			if err = bson.Unmarshal(data, &result); err != nil {
+				t.Fatal(err)
+			}
+			results = append(results, result)
+		}
+		return
+	}
+
+	// 数字 和 字符串 的 id 不合并 int32 解码为字段的 int64
+	counts, err := reflectCounts(reflectKeyType(reflect.TypeOf([]*int64{})), results(bson.M{"_id": int32(1), "n": 2}, bson.M{"_id": int64(2), "n": 3}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(counts, map[interface{}]int{int64(1): 2, int64(2): 3}) {
+		t.Errorf("counts = %v", counts)
+	}
+	counts, err = reflectCounts(reflectKeyType(nil), results(bson.M{"_id": 1, "n": 2}, bson.M{"_id": "1", "n": 3}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts[1] != 2 || counts["1"] != 3 {
+		t.Errorf("counts = %v", counts)
+	}
+
+	id := bson.NewObjectId()
+	counts, err = reflectCounts(reflectKeyType(reflect.TypeOf(id)), results(bson.M{"_id": id, "n": 1}, bson.M{"_id": id, "n": 4}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(counts) != 1 || counts[id] != 5 {
+		t.Errorf("counts = %v", counts)
+	}
+}
+
+func TestReflectFetchPipeline(t *testing.T) {
+	ids := []interface{}{1, 2}
+	match := bson.M{"user": bson.M{"$in": ids}}
+	pipeline := reflectFetchPipeline("user", match, ids, map[string]interface{}{"title": 1, "user": 1}, []string{"-createdAt"}, 3)
+	want := []bson.M{
+		{"$match": match},
+		{"$project": map[string]interface{}{"title": 1, "user": 1}},
+		{"$project": bson.M{"key": "$user", "document": "$$ROOT"}},
+		{"$unwind": "$key"},
+		{"$match": bson.M{"key": bson.M{"$in": ids}}},
+		{"$group": bson.M{"_id": "$key", "documents": bson.M{"$topN": bson.M{"n": 3, "sortBy": bson.D{{Name: "document.createdAt", Value: -1}}, "output": "$document"}}}},
+		{"$unwind": "$documents"},
+		{"$project": bson.M{"document": "$documents"}},
+		{"$sort": bson.D{{Name: "document.createdAt", Value: -1}}},
+	}
+	if !reflect.DeepEqual(pipeline, want) {
+		t.Errorf("pipeline = %#v\nwant %#v", pipeline, want)
+	}
+
+	// 没有 sort fields 的 不排序 不投影
+	pipeline = reflectFetchPipeline("_id", match, ids, nil, nil, 1)
+	for _, stage := range pipeline {
+		if _, ok := stage["$sort"]; ok {
+			t.Errorf("unexpected $sort %v", stage)
+		}
+	}
+	if len(pipeline) != 7 {
+		t.Errorf("pipeline = %v", pipeline)
+	}
+	// 没有 sort 的 每组 $firstN
+	group := pipeline[4]["$group"].(bson.M)
+	if !reflect.DeepEqual(group["documents"], bson.M{"$firstN": bson.M{"input": "$document", "n": 1}}) {
+		t.Errorf("group = %v", group)
+	}
+
+	// 聚合的结果 每个父级最多 skip+limit 个 再按父级 skip limit
+	var parents [2]struct {
+		Children []populateTestChild
+	}
+	children := []populateTestChild{{ID: 10}, {ID: 11}, {ID: 12}, {ID: 20}, {ID: 21}}
+	fetchIDs := [][]interface{}{{1}, {1}, {1}, {2}, {2}}
+	findValues := []reflectValue{
+		{value: reflect.ValueOf(&parents[0]).Elem().Field(0), ids: []interface{}{1}},
+		{value: reflect.ValueOf(&parents[1]).Elem().Field(0), ids: []interface{}{2}},
+	}
+	reflectAssign(findValues, reflect.ValueOf(children), fetchIDs, &Query{Options: QueryOptions{Sort: []string{"-createdAt"}, Skip: 1, Limit: 2}}, nil)
+	if len(parents[0].Children) != 2 || parents[0].Children[0].ID != 11 || parents[0].Children[1].ID != 12 {
+		t.Errorf("parent 1 children = %v", parents[0].Children)
+	}
+	if len(parents[1].Children) != 1 || parents[1].Children[0].ID != 21 {
+		t.Errorf("parent 2 children = %v", parents[1].Children)
+	}
+}
+
+func TestPolymorphicTarget(t *testing.T) {
+	users := &Model{Name: "app.users"}
+	posts := &Model{Name: "posts"}
+	logs := &Model{Name: "logs"}
+	registry := &Registry{}
+	registry.Register(users, posts)
+	ctx := context.Background()
+
+	tests := []struct {
+		kind    string
+		targets map[string]*Query
+		model   *Model
+	}{
+		{kind: "app.users", model: users},
+		{kind: "users", model: users},
+		{kind: "posts", model: posts},
+		// Targets 覆盖 registry
+		{kind: "posts", targets: map[string]*Query{"posts": logs.Query(ctx)}, model: logs},
+		{kind: "logs", targets: map[string]*Query{"logs": logs.Query(ctx)}, model: logs},
+		{kind: "logs"},
+	}
+	for _, test := range tests {
+		target, ok := polymorphicTarget(ctx, test.kind, &Query{Targets: test.targets, Options: QueryOptions{Missing: PopulateMissingSkip}}, registry)
+		if ok != (test.model != nil) {
+			t.Errorf("%s: ok = %v", test.kind, ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if target.Model != test.model {
+			t.Errorf("%s: model = %v", test.kind, target.Model)
+		}
+		if test.targets == nil && target.Options.Missing != PopulateMissingSkip {
+			t.Errorf("%s: missing = %s", test.kind, target.Options.Missing)
+		}
+	}
+}
+
+func TestReflectPolymorphicMissingTarget(t *testing.T) {
+	var parent struct {
+		Target interface{}
+	}
+	findValues := []reflectValue{{value: reflect.ValueOf(&parent).Elem().Field(0), ids: []interface{}{1}, kind: "unknown"}}
+	var populateField DocumentStructField
+	populateField.Populate.Find = "_id"
+	populateField.Populate.Discriminator = "type"
+
+	// Targets 和 DefaultRegistry 都没有的 type 按 Missing 处理
+	if err := reflectPolymorphic(context.Background(), "Target", populateField, findValues, &Query{}); err == nil {
+		t.Errorf("missing target without error")
+	}
+	if err := reflectPolymorphic(context.Background(), "Target", populateField, findValues, &Query{Options: QueryOptions{Missing: PopulateMissingSkip}}); err != nil || parent.Target != nil {
+		t.Errorf("skip: target = %v, err = %v", parent.Target, err)
+	}
+	ctx, report := WithPopulateReport(context.Background())
+	if err := reflectPolymorphic(ctx, "Target", populateField, findValues, &Query{Options: QueryOptions{Missing: PopulateMissingReport}}); err != nil {
+		t.Fatal(err)
+	}
+	if want := []PopulateMissing{{Path: "Target", Model: "unknown", IDs: []interface{}{1}}}; !reflect.DeepEqual(report.Missing, want) {
+		t.Errorf("report = %v, want %v", report.Missing, want)
+	}
+}
+
+type (
+	populateTestValueChild struct {
+		DocumentBase `json:"-" bson:"-"`
+		ID           int    `bson:"_id"`
+		Name         string `bson:"name"`
+	}
+
+	populateTestValueMid struct {
+		DocumentBase `json:"-" bson:"-"`
+		ID           int                    `bson:"_id"`
+		ChildID      int                    `bson:"child"`
+		Child        populateTestValueChild `bson:"-" populate:"ChildID"`
+	}
+
+	populateTestValueRoot struct {
+		DocumentBase `json:"-" bson:"-"`
+		ID           int                    `bson:"_id"`
+		MidIDs       []int                  `bson:"mids"`
+		Mids         []populateTestValueMid `bson:"-" populate:"MidIDs"`
+	}
+)
+
+func TestPopulateValueFields(t *testing.T) {
+	ctx, cache := WithPopulateCache(context.Background(), 0)
+	children := &Model{Name: "test.children", Document: &populateTestValueChild{}}
+	mids := &Model{Name: "test.mids", Document: &populateTestValueMid{}}
+
+	// 缓存中已经有的 不查询数据库
+	childQuery := children.Query(ctx)
+	key, err := populateCacheKey([]string{"ID"}, reflect.TypeOf(populateTestValueChild{}), childQuery)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := &populateCacheEntry{batches: map[interface{}]*populateBatch{}, documents: map[interface{}][]int{}}
+	for i, child := range []populateTestValueChild{{ID: 10, Name: "a"}, {ID: 11, Name: "b"}} {
+		batch := &populateBatch{done: make(chan struct{})}
+		close(batch.done)
+		entry.batches[child.ID] = batch
+		entry.values = append(entry.values, reflect.ValueOf(child))
+		entry.valueIDs = append(entry.valueIDs, []interface{}{child.ID})
+		entry.documents[child.ID] = []int{i}
+	}
+	cache.entries[key] = entry
+
+	// 已经填充的 值类型的 Mids 深度填充 Child 后写回
+	roots := []populateTestValueRoot{{ID: 1, MidIDs: []int{1, 2}, Mids: []populateTestValueMid{{ID: 1, ChildID: 10}, {ID: 2, ChildID: 11}}}}
+	populate := Populate{"Mids": mids.Query(ctx).PopulatePath("Child", childQuery)}
+	if err = populate.AllContext(ctx, &roots); err != nil {
+		t.Fatal(err)
+	}
+	if roots[0].Mids[0].Child.Name != "a" || roots[0].Mids[1].Child.Name != "b" {
+		t.Errorf("mids = %#v", roots[0].Mids)
+	}
+}
+
+func TestPopulateEach(t *testing.T) {
+	slotsContext := func(concurrency int) context.Context {
+		ctx := WithPopulateConcurrency(context.Background(), concurrency)
+		return context.WithValue(ctx, populateStateContextKey, populateStateFrom(ctx).withSlots())
+	}
+
+	// 所有层级一起 最多 2 个同时运行
+	var mutex sync.Mutex
+	var active, max, calls int
+	leaf := func(ctx context.Context, i int) error {
+		mutex.Lock()
+		active++
+		calls++
+		if active > max {
+			max = active
+		}
+		mutex.Unlock()
+		time.Sleep(5 * time.Millisecond)
+		mutex.Lock()
+		active--
+		mutex.Unlock()
+		return nil
+	}
+	errs := populateEach(slotsContext(2), 3, func(ctx context.Context, i int) error {
+		for _, err := range populateEach(ctx, 3, leaf) {
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if calls != 9 || max > 2 {
+		t.Errorf("calls = %d max = %d", calls, max)
+	}
+
+	// 1 个的 按顺序运行 失败后不再开始新的
+	var order []int
+	errFailed := errors.New("failed")
+	errs = populateEach(slotsContext(1), 4, func(ctx context.Context, i int) error {
+		order = append(order, i)
+		if i == 1 {
+			return errFailed
+		}
+		return nil
+	})
+	if !reflect.DeepEqual(order, []int{0, 1}) {
+		t.Errorf("order = %v", order)
+	}
+	if !reflect.DeepEqual(errs, []error{nil, errFailed, nil, nil}) {
+		t.Errorf("errs = %v", errs)
+	}
+
+	// 不限制的 全部同时运行
+	var started sync.WaitGroup
+	started.Add(3)
+	errs = populateEach(WithPopulateConcurrency(context.Background(), 0), 3, func(ctx context.Context, i int) error {
+		started.Done()
+		started.Wait()
+		return nil
+	})
+	if len(errs) != 3 {
+		t.Errorf("errs = %v", errs)
+	}
+}
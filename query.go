@@ -21,6 +21,18 @@ type (
 		Limit  int                    `json:"limit,omitempty"`
 		Hint   []string               `json:"hint,omitempty"`
 		Trash  int                    `json:"trashed,omitempty"`
+		// 不验证 update 文档
+		SkipValidate bool `json:"skipValidate,omitempty"`
+		// 不使用 model 的 DefaultScopes
+		Unscoped bool `json:"unscoped,omitempty"`
+		// 最大填充深度
+		PopulateDepth int `json:"populateDepth,omitempty"`
+		// 同时填充的路径数
+		PopulateConcurrency int `json:"populateConcurrency,omitempty"`
+		// 填充时 id 不存在的处理 PopulateMissing*
+		Missing string `json:"missing,omitempty"`
+		// 用 $lookup 填充
+		Lookup bool `json:"lookup,omitempty"`
 	}
 
 	Query struct {
@@ -29,7 +41,13 @@ type (
 		GetFunc  func(value interface{}, query *Query) *Query
 		Query    map[string]interface{}
 		Populate Populate
-		Options  QueryOptions
+		// 多态填充 type 字段的值 对应的 query 覆盖 registry 中的 model 都没有的按 Missing 处理
+		Targets map[string]*Query
+		Options QueryOptions
+		// 构建时的错误 (不存在的 scope) 由 Map 返回
+		err error
+		// 软删除的时间 级联删除的子级和父级相同
+		deletedAt time.Time
 	}
 )
 
@@ -144,7 +162,7 @@ func (query *Query) Nin(name string, value interface{}) *Query {
 }
 
 func (query *Query) Regex(name string, pattern string, options string) *Query {
-	return query.Name(name, "regex", bson.RegEx{pattern, options})
+	return query.Name(name, "regex", bson.RegEx{Pattern: pattern, Options: options})
 }
 
 func (query *Query) Fields(fields map[string]interface{}) *Query {
@@ -177,6 +195,48 @@ func (query *Query) Trash(trash int) *Query {
 	return query
 }
 
+// ReadPreference 读偏好 primary, primaryPreferred, secondary, secondaryPreferred, nearest
+func (query *Query) ReadPreference(readPreference string, tags ...bson.D) *Query {
+	query.Context = WithReadPreference(query.Context, readPreference, tags...)
+	return query
+}
+
+func (query *Query) WriteConcern(safe *mgo.Safe) *Query {
+	query.Context = WithWriteConcern(query.Context, safe)
+	return query
+}
+
+func (query *Query) ReadConcern(readConcern string) *Query {
+	query.Context = WithReadConcern(query.Context, readConcern)
+	return query
+}
+
+func (query *Query) Unscoped() *Query {
+	query.Options.Unscoped = true
+	return query
+}
+
+func (query *Query) SkipValidate() *Query {
+	query.Options.SkipValidate = true
+	return query
+}
+
+func (query *Query) PopulateDepth(depth int) *Query {
+	query.Options.PopulateDepth = depth
+	return query
+}
+
+func (query *Query) PopulateConcurrency(concurrency int) *Query {
+	query.Options.PopulateConcurrency = concurrency
+	return query
+}
+
+// Missing 作为填充的 query 时 id 不存在的处理
+func (query *Query) Missing(missing string) *Query {
+	query.Options.Missing = missing
+	return query
+}
+
 func (query *Query) PopulatePath(path string, value *Query) *Query {
 	if query.Populate == nil {
 		query.Populate = Populate{}
@@ -185,45 +245,149 @@ func (query *Query) PopulatePath(path string, value *Query) *Query {
 	return query
 }
 
+// Target 多态填充 type 字段的值为 name 时 使用的 query
+func (query *Query) Target(name string, value *Query) *Query {
+	if query.Targets == nil {
+		query.Targets = map[string]*Query{}
+	}
+	query.Targets[name] = value
+	return query
+}
+
 func (query *Query) One(document interface{}) (err error) {
-	if err = query.Model.DB(query.Context).Find(query.Map()).Select(query.Options.Fields).Sort(query.Options.Sort...).Skip(query.Options.Skip).Limit(1).One(document); err != nil {
+	var maps bson.M
+	if maps, err = query.Map(); err != nil {
+		return
+	}
+	var collection *mgo.Collection
+	var release func()
+	if collection, release, err = query.Model.DBContext(query.Context); err != nil {
+		return
+	}
+	defer release()
+	if query.Options.Lookup && query.Populate != nil {
+		return query.lookupOne(collection, document)
+	}
+	if err = collection.Find(maps).Select(query.Options.Fields).Sort(query.Options.Sort...).Skip(query.Options.Skip).Limit(1).One(document); err != nil {
 		return
 	}
 	if query.Populate != nil {
-		err = query.Populate.One(document)
+		err = query.Populate.OneContext(query.populateContext(), document)
 	}
 	return
 }
 
 func (query *Query) All(documents interface{}) (err error) {
-	if err = query.Model.DB(query.Context).Find(query.Map()).Select(query.Options.Fields).Sort(query.Options.Sort...).Skip(query.Options.Skip).Limit(query.Options.Limit).All(documents); err != nil {
+	var maps bson.M
+	if maps, err = query.Map(); err != nil {
+		return
+	}
+	var collection *mgo.Collection
+	var release func()
+	if collection, release, err = query.Model.DBContext(query.Context); err != nil {
+		return
+	}
+	defer release()
+	if query.Options.Lookup && query.Populate != nil {
+		return query.lookupAll(collection, documents, query.Options.Limit)
+	}
+	if err = collection.Find(maps).Select(query.Options.Fields).Sort(query.Options.Sort...).Skip(query.Options.Skip).Limit(query.Options.Limit).All(documents); err != nil {
 		return
 	}
 	if query.Populate != nil {
-		err = query.Populate.All(documents)
+		err = query.Populate.AllContext(query.populateContext(), documents)
+	}
+	return
+}
+
+func (query *Query) IDs() (ids []interface{}, err error) {
+	var maps bson.M
+	if maps, err = query.Map(); err != nil {
+		return
+	}
+	var collection *mgo.Collection
+	var release func()
+	if collection, release, err = query.Model.DBContext(query.Context); err != nil {
+		return
+	}
+	defer release()
+	var documents []struct {
+		ID interface{} `bson:"_id"`
+	}
+	if err = collection.Find(maps).Select(bson.M{"_id": 1}).Sort(query.Options.Sort...).Skip(query.Options.Skip).Limit(query.Options.Limit).All(&documents); err != nil {
+		return
+	}
+	for _, document := range documents {
+		ids = append(ids, document.ID)
 	}
 	return
 }
 
 func (query *Query) Count() (n int, err error) {
-	n, err = query.Model.DB(query.Context).Find(query.Map()).Skip(query.Options.Skip).Limit(query.Options.Limit).Count()
+	var maps bson.M
+	if maps, err = query.Map(); err != nil {
+		return
+	}
+	var collection *mgo.Collection
+	var release func()
+	if collection, release, err = query.Model.DBContext(query.Context); err != nil {
+		return
+	}
+	defer release()
+	n, err = collection.Find(maps).Skip(query.Options.Skip).Limit(query.Options.Limit).Count()
 	return
 }
 
 func (query *Query) Explain() (result map[string]interface{}, err error) {
+	var maps bson.M
+	if maps, err = query.Map(); err != nil {
+		return
+	}
+	var collection *mgo.Collection
+	var release func()
+	if collection, release, err = query.Model.DBContext(query.Context); err != nil {
+		return
+	}
+	defer release()
 	result = map[string]interface{}{}
-	err = query.Model.DB(query.Context).Find(query.Map()).Select(query.Options.Fields).Sort(query.Options.Sort...).Skip(query.Options.Skip).Limit(query.Options.Limit).Explain(result)
+	err = collection.Find(maps).Select(query.Options.Fields).Sort(query.Options.Sort...).Skip(query.Options.Skip).Limit(query.Options.Limit).Explain(result)
 	return
 }
 
 func (query *Query) Update(update interface{}) (err error) {
-	err = query.Model.DB(query.Context).Update(query.Map(), update)
+	var maps bson.M
+	if maps, err = query.Map(); err != nil {
+		return
+	}
+	var collection *mgo.Collection
+	var release func()
+	if collection, release, err = query.Model.DBContext(query.Context); err != nil {
+		return
+	}
+	defer release()
+	if err = query.validateUpdate(update); err != nil {
+		return
+	}
+	err = collection.Update(maps, update)
 	return
 }
 
 func (query *Query) UpdateAll(update interface{}) (i int, err error) {
+	var maps bson.M
+	if maps, err = query.Map(); err != nil {
+		return
+	}
+	var collection *mgo.Collection
+	var release func()
+	if collection, release, err = query.Model.DBContext(query.Context); err != nil {
+		return
+	}
+	defer release()
+	if err = query.validateUpdate(update); err != nil {
+		return
+	}
 	var info *mgo.ChangeInfo
-	if info, err = query.Model.DB(query.Context).UpdateAll(query.Map(), update); err != nil {
+	if info, err = collection.UpdateAll(maps, update); err != nil {
 		return
 	}
 	i = info.Updated
@@ -234,24 +398,65 @@ func (query *Query) UpdateAll(update interface{}) (i int, err error) {
 }
 
 func (query *Query) UpdateAndFind(update interface{}, document interface{}, isNew bool) (err error) {
-	if _, err = query.Model.DB(query.Context).Find(query.Map()).Select(query.Options.Fields).Sort(query.Options.Sort...).Skip(query.Options.Skip).Limit(query.Options.Limit).Apply(mgo.Change{Update: update, ReturnNew: isNew}, document); err != nil {
+	var maps bson.M
+	if maps, err = query.Map(); err != nil {
+		return
+	}
+	var collection *mgo.Collection
+	var release func()
+	if collection, release, err = query.Model.DBContext(query.Context); err != nil {
+		return
+	}
+	defer release()
+	if err = query.validateUpdate(update); err != nil {
+		return
+	}
+	if _, err = collection.Find(maps).Select(query.Options.Fields).Sort(query.Options.Sort...).Skip(query.Options.Skip).Limit(query.Options.Limit).Apply(mgo.Change{Update: update, ReturnNew: isNew}, document); err != nil {
 		return
 	}
 	return
 }
 
 func (query *Query) Delete() (err error) {
+	var maps bson.M
+	if maps, err = query.Map(); err != nil {
+		return
+	}
+	var collection *mgo.Collection
+	var release func()
+	if collection, release, err = query.Model.DBContext(query.Context); err != nil {
+		return
+	}
+	defer release()
+	query = query.deleting()
 	if update := query.deleteUpdate(); update != nil {
-		err = query.Model.DB(query.Context).Update(query.Map(), update)
+		if err = query.Model.DoRelation(query.Context, "delete", query.one()); err != nil {
+			return
+		}
+		err = collection.Update(maps, update)
 		return
 	}
 	return query.ForceDelete()
 }
 
 func (query *Query) DeleteAll() (i int, err error) {
+	var maps bson.M
+	if maps, err = query.Map(); err != nil {
+		return
+	}
+	var collection *mgo.Collection
+	var release func()
+	if collection, release, err = query.Model.DBContext(query.Context); err != nil {
+		return
+	}
+	defer release()
+	query = query.deleting()
 	if update := query.deleteUpdate(); update != nil {
+		if err = query.Model.DoRelation(query.Context, "delete", query.all()); err != nil {
+			return
+		}
 		var info *mgo.ChangeInfo
-		if info, err = query.Model.DB(query.Context).UpdateAll(query.Map(), update); err != nil {
+		if info, err = collection.UpdateAll(maps, update); err != nil {
 			return
 		}
 		i = info.Updated
@@ -264,13 +469,39 @@ func (query *Query) DeleteAll() (i int, err error) {
 }
 
 func (query *Query) ForceDelete() (err error) {
-	err = query.Model.DB(query.Context).Remove(query.Map())
+	var maps bson.M
+	if maps, err = query.Map(); err != nil {
+		return
+	}
+	var collection *mgo.Collection
+	var release func()
+	if collection, release, err = query.Model.DBContext(query.Context); err != nil {
+		return
+	}
+	defer release()
+	if err = query.Model.DoRelation(query.Context, "forceDelete", query.one()); err != nil {
+		return
+	}
+	err = collection.Remove(maps)
 	return
 }
 
 func (query *Query) ForceDeleteAll() (i int, err error) {
+	var maps bson.M
+	if maps, err = query.Map(); err != nil {
+		return
+	}
+	var collection *mgo.Collection
+	var release func()
+	if collection, release, err = query.Model.DBContext(query.Context); err != nil {
+		return
+	}
+	defer release()
+	if err = query.Model.DoRelation(query.Context, "forceDelete", query.all()); err != nil {
+		return
+	}
 	var info *mgo.ChangeInfo
-	if info, err = query.Model.DB(query.Context).RemoveAll(query.Map()); err != nil {
+	if info, err = collection.RemoveAll(maps); err != nil {
 		return
 	}
 	i = info.Removed
@@ -282,8 +513,21 @@ func (query *Query) ForceDeleteAll() (i int, err error) {
 }
 
 func (query *Query) Restore() (err error) {
+	var maps bson.M
+	if maps, err = query.Map(); err != nil {
+		return
+	}
+	var collection *mgo.Collection
+	var release func()
+	if collection, release, err = query.Model.DBContext(query.Context); err != nil {
+		return
+	}
+	defer release()
 	if update := query.restoreUpdate(); update != nil {
-		err = query.Model.DB(query.Context).Update(query.Map(), update)
+		if err = query.Model.DoRelation(query.Context, "restore", query.one()); err != nil {
+			return
+		}
+		err = collection.Update(maps, update)
 	} else {
 		err = mgo.ErrNotFound
 	}
@@ -291,9 +535,22 @@ func (query *Query) Restore() (err error) {
 }
 
 func (query *Query) RestoreAll() (i int, err error) {
+	var maps bson.M
+	if maps, err = query.Map(); err != nil {
+		return
+	}
+	var collection *mgo.Collection
+	var release func()
+	if collection, release, err = query.Model.DBContext(query.Context); err != nil {
+		return
+	}
+	defer release()
 	if update := query.restoreUpdate(); update != nil {
+		if err = query.Model.DoRelation(query.Context, "restore", query.all()); err != nil {
+			return
+		}
 		var info *mgo.ChangeInfo
-		if info, err = query.Model.DB(query.Context).UpdateAll(query.Map(), update); err != nil {
+		if info, err = collection.UpdateAll(maps, update); err != nil {
 			return
 		}
 		i = info.Updated
@@ -306,7 +563,17 @@ func (query *Query) RestoreAll() (i int, err error) {
 	return
 }
 
-func (query *Query) Map() (maps bson.M) {
+// Err 构建 query 时的错误
+func (query *Query) Err() error {
+	return query.err
+}
+
+// Map 查询条件 构建时有错误 或 DefaultScopes 返回错误的 不查询
+func (query *Query) Map() (maps bson.M, err error) {
+	if query.err != nil {
+		err = query.err
+		return
+	}
 	maps = bson.M{}
 	var expr []map[string]interface{}
 	for name, value := range query.Query {
@@ -370,6 +637,27 @@ func (query *Query) Map() (maps bson.M) {
 		maps["$expr"] = mapexpr
 	}
 
+	// 行级过滤 合并到 $and
+	if !query.Options.Unscoped {
+		var filters []map[string]interface{}
+		if filters, err = query.Model.DefaultScope(query.Context); err != nil {
+			maps = nil
+			return
+		}
+		if len(filters) != 0 {
+			var and []interface{}
+			if val := reflect.ValueOf(maps["$and"]); val.Kind() == reflect.Slice {
+				for i := 0; i < val.Len(); i++ {
+					and = append(and, val.Index(i).Interface())
+				}
+			}
+			for _, filter := range filters {
+				and = append(and, filter)
+			}
+			maps["$and"] = and
+		}
+	}
+
 	// 回收站 过滤器
 	if query.Options.Trash > 0 {
 		documentStruct := query.Model.DocumentStruct()
@@ -397,6 +685,70 @@ func (query *Query) Map() (maps bson.M) {
 	return
 }
 
+func (query *Query) validateUpdate(update interface{}) (err error) {
+	if query.Options.SkipValidate {
+		return
+	}
+	return query.Model.ValidateUpdate(update)
+}
+
+func (query *Query) populateContext() context.Context {
+	ctx := query.Context
+	if query.Options.PopulateDepth > 0 {
+		ctx = WithPopulateDepth(ctx, query.Options.PopulateDepth)
+	}
+	if query.Options.PopulateConcurrency > 0 {
+		ctx = WithPopulateConcurrency(ctx, query.Options.PopulateConcurrency)
+	}
+	return ctx
+}
+
+// Clone 复制 query 条件 可以再修改
+func (query *Query) Clone() *Query {
+	q := *query
+	if query.Query != nil {
+		q.Query = make(map[string]interface{}, len(query.Query))
+		for name, value := range query.Query {
+			if valueMap, ok := value.(map[string]interface{}); ok {
+				val := make(map[string]interface{}, len(valueMap))
+				for operator, v := range valueMap {
+					val[operator] = v
+				}
+				value = val
+			}
+			q.Query[name] = value
+		}
+	}
+	return &q
+}
+
+// one 只匹配第一个 同 mgo Update Remove
+func (query *Query) one() *Query {
+	q := *query
+	q.Options.Sort = nil
+	q.Options.Skip = 0
+	q.Options.Limit = 1
+	return &q
+}
+
+// all 匹配所有 同 mgo UpdateAll RemoveAll
+func (query *Query) all() *Query {
+	q := *query
+	q.Options.Sort = nil
+	q.Options.Skip = 0
+	q.Options.Limit = 0
+	return &q
+}
+
+// deleting 设置软删除的时间
+func (query *Query) deleting() *Query {
+	q := *query
+	if q.deletedAt.IsZero() {
+		q.deletedAt = time.Now()
+	}
+	return &q
+}
+
 func (query *Query) deleteUpdate() (update bson.M) {
 	documentStruct := query.Model.DocumentStruct()
 	set := bson.M{}
@@ -404,7 +756,11 @@ func (query *Query) deleteUpdate() (update bson.M) {
 		set[tag.BSON] = true
 	}
 	if tag, ok := documentStruct["DeletedAt"]; ok && tag.BSON != "" {
-		set[tag.BSON] = time.Now()
+		deletedAt := query.deletedAt
+		if deletedAt.IsZero() {
+			deletedAt = time.Now()
+		}
+		set[tag.BSON] = deletedAt
 	}
 	if len(set) != 0 {
 		update = map[string]interface{}{"$set": set}
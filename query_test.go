@@ -0,0 +1,62 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+func TestQueryMapDefaultScope(t *testing.T) {
+	errTenant := errors.New("tenant not found")
+	model := &Model{Name: "users", DefaultScopes: []ModelDefaultScope{
+		func(ctx context.Context) (map[string]interface{}, error) {
+			return map[string]interface{}{"org": 1}, nil
+		},
+		func(ctx context.Context) (map[string]interface{}, error) {
+			return nil, nil
+		},
+	}}
+	maps, err := model.Query(context.Background()).Eq("name", "a").Map()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (bson.M{"name": "a", "$and": []interface{}{map[string]interface{}{"org": 1}}}); !reflect.DeepEqual(maps, want) {
+		t.Errorf("maps = %#v, want %#v", maps, want)
+	}
+
+	if maps, err = model.Query(context.Background()).Unscoped().Map(); err != nil || len(maps) != 0 {
+		t.Errorf("unscoped maps = %#v, %v", maps, err)
+	}
+
+	model.DefaultScopes = append(model.DefaultScopes, func(ctx context.Context) (map[string]interface{}, error) {
+		return nil, errTenant
+	})
+	if maps, err = model.Query(context.Background()).Map(); err != errTenant || maps != nil {
+		t.Errorf("maps = %#v, err = %v", maps, err)
+	}
+}
+
+func TestQueryScope(t *testing.T) {
+	model := &Model{Name: "users"}
+	model.OnScope("active", "", func(query *Query, args ...interface{}) *Query {
+		return query.Eq("active", true)
+	})
+	maps, err := model.Query(context.Background()).Scope("active").Map()
+	if err != nil || !reflect.DeepEqual(maps, bson.M{"active": true}) {
+		t.Errorf("maps = %#v, err = %v", maps, err)
+	}
+
+	query := model.Query(context.Background()).Scope("unknown").Scope("active")
+	if query.Err() == nil {
+		t.Fatal("unknown scope without error")
+	}
+	if maps, err = query.Map(); err != query.Err() || maps != nil {
+		t.Errorf("maps = %#v, err = %v", maps, err)
+	}
+	if err = query.Clone().All(&[]bson.M{}); err != query.Err() {
+		t.Errorf("All err = %v", err)
+	}
+}
@@ -0,0 +1,143 @@
+package model
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type (
+	Registry struct {
+		m     sync.RWMutex
+		names map[string]*Model
+		types map[reflect.Type]*Model
+	}
+
+	RegistrySync struct {
+		Name    string   `json:"name"`
+		Created bool     `json:"created,omitempty"`
+		Updated []string `json:"updated,omitempty"`
+		Error   error    `json:"-"`
+	}
+)
+
+var DefaultRegistry = &Registry{}
+
+// SyncAll 同时同步的 model 数
+var RegistrySyncConcurrency = 4
+
+func Register(models ...*Model) {
+	DefaultRegistry.Register(models...)
+}
+
+func (registry *Registry) Register(models ...*Model) {
+	registry.m.Lock()
+	defer registry.m.Unlock()
+	if registry.names == nil {
+		registry.names = map[string]*Model{}
+		registry.types = map[reflect.Type]*Model{}
+	}
+	for _, model := range models {
+		registry.names[model.Name] = model
+		if model.Document != nil {
+			registry.types[reflect.Indirect(reflect.ValueOf(model.Document)).Type()] = model
+		}
+	}
+}
+
+// Model 根据名字查找 先匹配完整的 db.collection 再匹配 collection
+// 多个数据库有相同 collection 的 不确定是哪个 返回 false
+func (registry *Registry) Model(name string) (model *Model, ok bool) {
+	registry.m.RLock()
+	defer registry.m.RUnlock()
+	if model, ok = registry.names[name]; ok {
+		return
+	}
+	for _, val := range registry.names {
+		if _, collection := val.names(); collection == name {
+			if model != nil {
+				return nil, false
+			}
+			model = val
+		}
+	}
+	ok = model != nil
+	return
+}
+
+// ModelByType 根据 document 类型查找 指针 切片 会找子级
+func (registry *Registry) ModelByType(t reflect.Type) (model *Model, ok bool) {
+	for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice || t.Kind() == reflect.Array || t.Kind() == reflect.Map {
+		t = t.Elem()
+	}
+	registry.m.RLock()
+	defer registry.m.RUnlock()
+	model, ok = registry.types[t]
+	return
+}
+
+func (registry *Registry) Models() (models []*Model) {
+	registry.m.RLock()
+	defer registry.m.RUnlock()
+	for _, model := range registry.names {
+		models = append(models, model)
+	}
+	sort.Slice(models, func(i, j int) bool {
+		return models[i].Name < models[j].Name
+	})
+	return
+}
+
+// SyncAll 最多 RegistrySyncConcurrency 个同时 创建集合 同步 index
+func (registry *Registry) SyncAll(ctx context.Context) (results []RegistrySync, err error) {
+	models := registry.Models()
+	results = make([]RegistrySync, len(models))
+
+	registryRun(len(models), RegistrySyncConcurrency, func(i int) {
+		result, model := &results[i], models[i]
+		result.Name = model.Name
+		// 新建的 create 中已经 Update
+		if result.Created, result.Updated, result.Error = model.create(ctx); result.Error != nil || result.Created {
+			return
+		}
+		result.Updated, result.Error = model.Update(ctx)
+	})
+
+	var messages []string
+	for _, result := range results {
+		if result.Error != nil {
+			messages = append(messages, result.Name+": "+result.Error.Error())
+		}
+	}
+	if len(messages) != 0 {
+		err = fmt.Errorf("Registry sync %s", strings.Join(messages, "; "))
+	}
+	return
+}
+
+// registryRun 最多 concurrency 个同时运行 fn(0) ... fn(n-1)
+func registryRun(n int, concurrency int, fn func(i int)) {
+	if concurrency <= 0 || concurrency > n {
+		concurrency = n
+	}
+	indexs := make(chan int, n)
+	for i := 0; i < n; i++ {
+		indexs <- i
+	}
+	close(indexs)
+
+	var wg sync.WaitGroup
+	wg.Add(concurrency)
+	for j := 0; j < concurrency; j++ {
+		go func() {
+			defer wg.Done()
+			for i := range indexs {
+				fn(i)
+			}
+		}()
+	}
+	wg.Wait()
+}
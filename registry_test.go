@@ -0,0 +1,80 @@
+package model
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+type registryTestDocument struct {
+	DocumentBase `json:"-" bson:"-"`
+	ID           int `bson:"_id"`
+}
+
+func TestRegistryModel(t *testing.T) {
+	users := &Model{Name: "app.users", Document: &registryTestDocument{}}
+	otherUsers := &Model{Name: "other.users"}
+	posts := &Model{Name: "posts"}
+	registry := &Registry{}
+	registry.Register(users, otherUsers, posts)
+
+	tests := []struct {
+		name  string
+		model *Model
+	}{
+		{name: "app.users", model: users},
+		{name: "other.users", model: otherUsers},
+		{name: "posts", model: posts},
+		// 多个数据库都有 不确定
+		{name: "users"},
+		{name: "comments"},
+	}
+	for _, test := range tests {
+		model, ok := registry.Model(test.name)
+		if ok != (test.model != nil) || model != test.model {
+			t.Errorf("%s: model = %v, ok = %v", test.name, model, ok)
+		}
+	}
+
+	if model, ok := registry.ModelByType(reflect.TypeOf([]*registryTestDocument{})); !ok || model != users {
+		t.Errorf("type model = %v", model)
+	}
+	var names []string
+	for _, model := range registry.Models() {
+		names = append(names, model.Name)
+	}
+	if want := []string{"app.users", "other.users", "posts"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("models = %v, want %v", names, want)
+	}
+}
+
+func TestRegistryRun(t *testing.T) {
+	var m sync.Mutex
+	var running, max int
+	done := make([]bool, 20)
+	registryRun(len(done), 3, func(i int) {
+		m.Lock()
+		running++
+		if running > max {
+			max = running
+		}
+		m.Unlock()
+		time.Sleep(time.Millisecond)
+		m.Lock()
+		running--
+		done[i] = true
+		m.Unlock()
+	})
+	if max > 3 {
+		t.Errorf("max concurrency = %d", max)
+	}
+	for i, ok := range done {
+		if !ok {
+			t.Errorf("%d not run", i)
+		}
+	}
+	registryRun(0, 3, func(i int) {
+		t.Errorf("run %d", i)
+	})
+}
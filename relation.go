@@ -0,0 +1,202 @@
+package model
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+type (
+	ModelRelation struct {
+		// 子级 model
+		Model ModelInterface
+		// 子级 储存父级 ID 的 bson 字段
+		Field string
+		// 删除策略
+		OnDelete string
+	}
+
+	// relationParent 父级的 id 和 软删除时间
+	relationParent struct {
+		id        interface{}
+		deletedAt time.Time
+	}
+
+	// relationChange 一个子级 query 的操作 count, delete, forceDelete, restore, unset
+	relationChange struct {
+		field  string
+		action string
+		query  *Query
+	}
+)
+
+const (
+	// 子级 跟父级一样删除 软删除时 不支持软删除的子级强制删除 恢复时一起恢复
+	RelationCascade = "cascade"
+	// 子级 软删除 恢复时一起恢复 软删除时 不支持软删除的子级不处理
+	RelationSoftCascade = "soft-cascade"
+	// 子级 字段 unset
+	RelationSetNull = "set-null"
+	// 有子级 不允许删除
+	RelationRestrict = "restrict"
+)
+
+// DoRelation 在父级 delete, forceDelete, restore 之前处理子级
+// mgo 不支持事务 所以先检查 restrict 再处理子级
+// query 只用查询条件 和 Limit (单个操作的 1) 不用 skip sort
+func (model *Model) DoRelation(ctx context.Context, name string, query *Query) (err error) {
+	if len(model.Relations) == 0 {
+		return
+	}
+	var parents []relationParent
+	if parents, err = relationParents(query); err != nil || len(parents) == 0 {
+		return
+	}
+	var changes []relationChange
+	if changes, err = model.relationChanges(ctx, name, query, parents); err != nil {
+		return
+	}
+
+	// 限制
+	for _, change := range changes {
+		if change.action != "count" {
+			continue
+		}
+		var n int
+		if n, err = change.query.Count(); err != nil {
+			return
+		}
+		if n != 0 {
+			err = fmt.Errorf("Relation restrict (%s) %d", change.field, n)
+			return
+		}
+	}
+
+	for _, change := range changes {
+		switch change.action {
+		case "delete":
+			_, err = change.query.DeleteAll()
+		case "forceDelete":
+			_, err = change.query.ForceDeleteAll()
+		case "restore":
+			// 不支持软删除的 没有可恢复的
+			if _, err = change.query.RestoreAll(); err == mgo.ErrNotFound {
+				err = nil
+			}
+		case "unset":
+			_, err = change.query.UpdateAll(bson.M{"$unset": bson.M{change.field: ""}})
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// relationParents 查询条件匹配的 父级 id 和 DeletedAt
+func relationParents(query *Query) (parents []relationParent, err error) {
+	var maps bson.M
+	if maps, err = query.Map(); err != nil {
+		return
+	}
+	var collection *mgo.Collection
+	var release func()
+	if collection, release, err = query.Model.DBContext(query.Context); err != nil {
+		return
+	}
+	defer release()
+
+	fields := bson.M{"_id": 1}
+	var deletedAt string
+	if tag, ok := query.Model.DocumentStruct()["DeletedAt"]; ok && tag.BSON != "" {
+		deletedAt = tag.BSON
+		fields[deletedAt] = 1
+	}
+	var documents []bson.M
+	if err = collection.Find(maps).Select(fields).Limit(query.Options.Limit).All(&documents); err != nil {
+		return
+	}
+	for _, document := range documents {
+		parent := relationParent{id: document["_id"]}
+		if deletedAt != "" {
+			parent.deletedAt, _ = document[deletedAt].(time.Time)
+		}
+		parents = append(parents, parent)
+	}
+	return
+}
+
+// relationChanges 每个子级的操作 不使用子级的 DefaultScopes 当前看不到的子级也要处理
+func (model *Model) relationChanges(ctx context.Context, name string, query *Query, parents []relationParent) (changes []relationChange, err error) {
+	ids := make([]interface{}, 0, len(parents))
+	for _, parent := range parents {
+		ids = append(ids, parent.id)
+	}
+	for _, relation := range model.Relations {
+		q := relation.Model.Query(ctx).Unscoped().In(relation.Field, ids)
+		switch relation.OnDelete {
+		case RelationCascade, RelationSoftCascade:
+			switch name {
+			case "delete":
+				// 子级不支持软删除 DeleteAll 会强制删除  删除时间和父级相同
+				if relation.OnDelete == RelationCascade || q.deleteUpdate() != nil {
+					q.deletedAt = query.deletedAt
+					changes = append(changes, relationChange{field: relation.Field, action: "delete", query: q.Trash(-1)})
+				}
+			case "forceDelete":
+				changes = append(changes, relationChange{field: relation.Field, action: "forceDelete", query: q})
+			case "restore":
+				changes = append(changes, relationRestore(ctx, relation, query, parents)...)
+			}
+		case RelationSetNull:
+			if name != "restore" {
+				changes = append(changes, relationChange{field: relation.Field, action: "unset", query: q})
+			}
+		case RelationRestrict:
+			if name != "restore" {
+				changes = append(changes, relationChange{field: relation.Field, action: "count", query: q.Trash(-1)})
+			}
+		default:
+			err = fmt.Errorf("Relation OnDelete (%s) invalid", relation.OnDelete)
+			return
+		}
+	}
+	return
+}
+
+// relationRestore 只恢复和父级一起删除的子级 (DeletedAt 相同)
+// 父级 或 子级 没有 DeletedAt 的 不能区分 恢复所有已删除的子级
+func relationRestore(ctx context.Context, relation ModelRelation, query *Query, parents []relationParent) (changes []relationChange) {
+	_, parentOk := query.Model.DocumentStruct()["DeletedAt"]
+	tag, ok := relation.Model.DocumentStruct()["DeletedAt"]
+	if !parentOk || !ok || tag.BSON == "" {
+		ids := make([]interface{}, 0, len(parents))
+		for _, parent := range parents {
+			ids = append(ids, parent.id)
+		}
+		changes = append(changes, relationChange{field: relation.Field, action: "restore", query: relation.Model.Query(ctx).Unscoped().In(relation.Field, ids).Trash(1)})
+		return
+	}
+
+	// 按父级删除时间分组 没有删除的父级 没有要恢复的子级
+	var times []time.Time
+	groups := map[int64][]interface{}{}
+	for _, parent := range parents {
+		if parent.deletedAt.IsZero() {
+			continue
+		}
+		key := parent.deletedAt.UnixNano()
+		if _, ok := groups[key]; !ok {
+			times = append(times, parent.deletedAt)
+		}
+		groups[key] = append(groups[key], parent.id)
+	}
+	for _, deletedAt := range times {
+		q := relation.Model.Query(ctx).Unscoped().In(relation.Field, groups[deletedAt.UnixNano()]).Eq(tag.BSON, deletedAt).Trash(1)
+		changes = append(changes, relationChange{field: relation.Field, action: "restore", query: q})
+	}
+	return
+}
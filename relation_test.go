@@ -0,0 +1,146 @@
+package model
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+type (
+	relationTestPost struct {
+		DocumentBase `json:"-" bson:"-"`
+		ID           int       `bson:"_id"`
+		DeletedAt    time.Time `bson:"deletedAt,omitempty"`
+	}
+
+	relationTestComment struct {
+		DocumentBase `json:"-" bson:"-"`
+		ID           int       `bson:"_id"`
+		PostID       int       `bson:"post"`
+		DeletedAt    time.Time `bson:"deletedAt,omitempty"`
+	}
+
+	relationTestLike struct {
+		DocumentBase `json:"-" bson:"-"`
+		ID           int `bson:"_id"`
+		PostID       int `bson:"post"`
+	}
+
+	relationTestFlag struct {
+		DocumentBase `json:"-" bson:"-"`
+		ID           int  `bson:"_id"`
+		PostID       int  `bson:"post"`
+		Deleted      bool `bson:"deleted"`
+	}
+)
+
+func TestRelationChanges(t *testing.T) {
+	ctx := context.Background()
+	// 子级的 DefaultScopes 不限制 restrict 和 cascade
+	comments := &Model{Name: "comments", Document: &relationTestComment{}, DefaultScopes: []ModelDefaultScope{
+		func(ctx context.Context) (map[string]interface{}, error) {
+			return map[string]interface{}{"org": 1}, nil
+		},
+	}}
+	likes := &Model{Name: "likes", Document: &relationTestLike{}}
+	flags := &Model{Name: "flags", Document: &relationTestFlag{}}
+	deletedAt := time.Date(2020, 1, 2, 3, 4, 5, 6000000, time.UTC)
+	other := deletedAt.Add(time.Hour)
+	parents := []relationParent{{id: 1, deletedAt: deletedAt}, {id: 2, deletedAt: other}, {id: 3, deletedAt: deletedAt}, {id: 4}}
+	ids := []interface{}{1, 2, 3, 4}
+	in := func(ids ...interface{}) map[string]interface{} {
+		return map[string]interface{}{"$in": ids}
+	}
+
+	type change struct {
+		action string
+		maps   bson.M
+	}
+	tests := []struct {
+		name      string
+		op        string
+		relations []ModelRelation
+		changes   []change
+		err       bool
+	}{
+		{name: "restrict", op: "delete", relations: []ModelRelation{{Model: comments, Field: "post", OnDelete: RelationRestrict}}, changes: []change{
+			{action: "count", maps: bson.M{"post": in(ids...), "deletedAt": map[string]interface{}{"$exists": false}}},
+		}},
+		{name: "restrict restore", op: "restore", relations: []ModelRelation{{Model: comments, Field: "post", OnDelete: RelationRestrict}}},
+		{name: "cascade", op: "delete", relations: []ModelRelation{{Model: comments, Field: "post", OnDelete: RelationCascade}, {Model: likes, Field: "post", OnDelete: RelationCascade}}, changes: []change{
+			{action: "delete", maps: bson.M{"post": in(ids...), "deletedAt": map[string]interface{}{"$exists": false}}},
+			{action: "delete", maps: bson.M{"post": in(ids...)}},
+		}},
+		{name: "soft cascade", op: "delete", relations: []ModelRelation{{Model: comments, Field: "post", OnDelete: RelationSoftCascade}, {Model: likes, Field: "post", OnDelete: RelationSoftCascade}}, changes: []change{
+			{action: "delete", maps: bson.M{"post": in(ids...), "deletedAt": map[string]interface{}{"$exists": false}}},
+		}},
+		{name: "force delete", op: "forceDelete", relations: []ModelRelation{{Model: likes, Field: "post", OnDelete: RelationSoftCascade}}, changes: []change{
+			{action: "forceDelete", maps: bson.M{"post": in(ids...)}},
+		}},
+		{name: "set null", op: "delete", relations: []ModelRelation{{Model: likes, Field: "post", OnDelete: RelationSetNull}}, changes: []change{
+			{action: "unset", maps: bson.M{"post": in(ids...)}},
+		}},
+		{name: "restore", op: "restore", relations: []ModelRelation{{Model: comments, Field: "post", OnDelete: RelationCascade}}, changes: []change{
+			{action: "restore", maps: bson.M{"post": in(1, 3), "deletedAt": deletedAt}},
+			{action: "restore", maps: bson.M{"post": in(2), "deletedAt": other}},
+		}},
+		{name: "restore without deletedAt", op: "restore", relations: []ModelRelation{{Model: flags, Field: "post", OnDelete: RelationSoftCascade}}, changes: []change{
+			{action: "restore", maps: bson.M{"post": in(ids...), "deleted": true}},
+		}},
+		{name: "invalid", op: "delete", relations: []ModelRelation{{Model: likes, Field: "post", OnDelete: "unknown"}}, err: true},
+	}
+	for _, test := range tests {
+		posts := &Model{Name: "posts", Document: &relationTestPost{}, Relations: test.relations}
+		query := posts.Query(ctx).deleting()
+		changes, err := posts.relationChanges(ctx, test.op, query, parents)
+		if (err != nil) != test.err {
+			t.Errorf("%s: err = %v", test.name, err)
+			continue
+		}
+		if len(changes) != len(test.changes) {
+			t.Errorf("%s: changes = %v", test.name, changes)
+			continue
+		}
+		for i, change := range changes {
+			maps, err := change.query.Map()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if change.action != test.changes[i].action || !reflect.DeepEqual(maps, test.changes[i].maps) {
+				t.Errorf("%s: change %d = %s %#v, want %s %#v", test.name, i, change.action, maps, test.changes[i].action, test.changes[i].maps)
+			}
+			// 级联软删除的子级 和父级的删除时间相同
+			if change.action == "delete" && change.query.deletedAt != query.deletedAt {
+				t.Errorf("%s: deletedAt = %v, want %v", test.name, change.query.deletedAt, query.deletedAt)
+			}
+		}
+	}
+}
+
+func TestQueryRelationOptions(t *testing.T) {
+	posts := &Model{Name: "posts", Document: &relationTestPost{}}
+	query := posts.Query(context.Background()).Sort("-_id").Skip(5).Limit(10)
+
+	// DeleteAll RemoveAll 不用 skip limit sort  单个的只用第一个
+	if all := query.all(); all.Options.Limit != 0 || all.Options.Skip != 0 || all.Options.Sort != nil {
+		t.Errorf("all options = %#v", all.Options)
+	}
+	if one := query.one(); one.Options.Limit != 1 || one.Options.Skip != 0 || one.Options.Sort != nil {
+		t.Errorf("one options = %#v", one.Options)
+	}
+	if query.Options.Limit != 10 {
+		t.Errorf("query modified %#v", query.Options)
+	}
+
+	deleting := query.deleting()
+	update := deleting.deleteUpdate()
+	if deletedAt := update["$set"].(bson.M)["deletedAt"]; deletedAt != deleting.deletedAt || deleting.deletedAt.IsZero() {
+		t.Errorf("deletedAt = %v, want %v", deletedAt, deleting.deletedAt)
+	}
+	if deleting.deleting().deletedAt != deleting.deletedAt {
+		t.Errorf("deleting changed deletedAt")
+	}
+}
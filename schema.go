@@ -0,0 +1,222 @@
+package model
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+var (
+	schemaTimeType     = reflect.TypeOf(time.Time{})
+	schemaObjectIdType = reflect.TypeOf(bson.ObjectId(""))
+	schemaBytesType    = reflect.TypeOf([]byte{})
+)
+
+// JSONSchema 根据 DocumentStruct 生成 $jsonSchema
+func (model *Model) JSONSchema() bson.M {
+	return DocumentStructSchema(model.DocumentStruct())
+}
+
+func DocumentStructSchema(documentStruct DocumentStruct) (schema bson.M) {
+	properties := bson.M{}
+	var required []string
+	for _, fieldStruct := range documentStruct {
+		if fieldStruct.BSON == "" || fieldStruct.Type == nil {
+			continue
+		}
+		properties[fieldStruct.BSON] = schemaField(fieldStruct.Type, fieldStruct.Children, fieldStruct.Validate)
+		if fieldStruct.BSON == "_id" {
+			required = append(required, fieldStruct.BSON)
+			continue
+		}
+		for _, rule := range fieldStruct.Validate {
+			if rule.Name == "dive" {
+				break
+			}
+			if rule.Name == "required" {
+				required = append(required, fieldStruct.BSON)
+				break
+			}
+		}
+	}
+	schema = bson.M{"bsonType": "object"}
+	if len(properties) != 0 {
+		schema["properties"] = properties
+	}
+	if len(required) != 0 {
+		sort.Strings(required)
+		schema["required"] = required
+	}
+	return
+}
+
+func schemaField(t reflect.Type, children DocumentStruct, rules []ValidateRule) (schema bson.M) {
+	schema = bson.M{}
+	var nullable bool
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+		nullable = true
+	}
+
+	var bsonType []string
+	switch {
+	case t == schemaTimeType:
+		bsonType = []string{"date"}
+	case t == schemaObjectIdType:
+		bsonType = []string{"objectId"}
+	case t == schemaBytesType:
+		bsonType = []string{"binData"}
+	default:
+		switch t.Kind() {
+		case reflect.String:
+			bsonType = []string{"string"}
+		case reflect.Bool:
+			bsonType = []string{"bool"}
+		case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint8, reflect.Uint16:
+			bsonType = []string{"int"}
+		case reflect.Int64:
+			bsonType = []string{"long"}
+		case reflect.Int, reflect.Uint, reflect.Uint32, reflect.Uint64:
+			bsonType = []string{"int", "long"}
+		case reflect.Float32, reflect.Float64:
+			bsonType = []string{"double"}
+		case reflect.Slice, reflect.Array:
+			bsonType = []string{"array"}
+			nullable = nullable || t.Kind() == reflect.Slice
+			var elemRules []ValidateRule
+			for i, rule := range rules {
+				if rule.Name == "dive" {
+					elemRules = rules[i+1:]
+					rules = rules[:i]
+					break
+				}
+			}
+			if items := schemaField(t.Elem(), children, elemRules); len(items) != 0 {
+				schema["items"] = items
+			}
+		case reflect.Map:
+			bsonType = []string{"object"}
+			nullable = true
+		case reflect.Struct:
+			bsonType = []string{"object"}
+			if children != nil {
+				for key, val := range DocumentStructSchema(children) {
+					schema[key] = val
+				}
+			}
+		}
+	}
+	// interface 不限制类型
+	if len(bsonType) == 0 {
+		return
+	}
+	if nullable {
+		bsonType = append(bsonType, "null")
+	}
+	if len(bsonType) == 1 {
+		schema["bsonType"] = bsonType[0]
+	} else {
+		schema["bsonType"] = bsonType
+	}
+
+	for _, rule := range rules {
+		if rule.Name == "dive" {
+			break
+		}
+		param, _ := strconv.ParseFloat(rule.Param, 64)
+		switch bsonType[0] {
+		case "string":
+			switch rule.Name {
+			case "min":
+				schema["minLength"] = int(param)
+			case "max":
+				schema["maxLength"] = int(param)
+			case "len":
+				schema["minLength"] = int(param)
+				schema["maxLength"] = int(param)
+			case "regex":
+				schema["pattern"] = rule.Param
+			case "enum":
+				schema["enum"] = strings.Split(rule.Param, "|")
+			}
+		case "array":
+			switch rule.Name {
+			case "min":
+				schema["minItems"] = int(param)
+			case "max":
+				schema["maxItems"] = int(param)
+			case "len":
+				schema["minItems"] = int(param)
+				schema["maxItems"] = int(param)
+			}
+		case "int", "long", "double":
+			switch rule.Name {
+			case "min":
+				schema["minimum"] = param
+			case "max":
+				schema["maximum"] = param
+			}
+		}
+	}
+	return
+}
+
+// updateSchema 对比服务器的 validator 不同就 collMod  去掉 Schema 的 发送空的 validator
+func (model *Model) updateSchema(ctx context.Context) (updated bool, err error) {
+	var db *mgo.Database
+	var name string
+	var options collectionOptions
+	var exists bool
+	if db, name, options, exists, err = model.collectionInfo(ctx); err != nil || !exists {
+		return
+	}
+
+	validator := model.validator()
+	if validator == nil {
+		if _, ok := options.Validator["$jsonSchema"]; !ok {
+			return
+		}
+		if err = db.Run(bson.D{{Name: "collMod", Value: name}, {Name: "validator", Value: bson.M{}}}, nil); err != nil {
+			err = fmt.Errorf("collMod %s: %s", name, err.Error())
+			return
+		}
+		updated = true
+		return
+	}
+
+	// bson 序列化后比较
+	var data []byte
+	if data, err = bson.Marshal(validator); err != nil {
+		return
+	}
+	validator = bson.M{}
+	if err = bson.Unmarshal(data, &validator); err != nil {
+		return
+	}
+	if reflect.DeepEqual(options.Validator, validator) &&
+		(model.ValidationLevel == "" || model.ValidationLevel == options.ValidationLevel) &&
+		(model.ValidationAction == "" || model.ValidationAction == options.ValidationAction) {
+		return
+	}
+
+	command := bson.D{{Name: "collMod", Value: name}, {Name: "validator", Value: validator}}
+	if model.ValidationLevel != "" {
+		command = append(command, bson.DocElem{Name: "validationLevel", Value: model.ValidationLevel})
+	}
+	if model.ValidationAction != "" {
+		command = append(command, bson.DocElem{Name: "validationAction", Value: model.ValidationAction})
+	}
+	if err = db.Run(command, nil); err != nil {
+		err = fmt.Errorf("collMod %s: %s", name, err.Error())
+		return
+	}
+	updated = true
+	return
+}
@@ -0,0 +1,117 @@
+package model
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+type (
+	schemaTestAddress struct {
+		City string `bson:"city" validate:"required,max=20"`
+	}
+
+	schemaTestDocument struct {
+		DocumentBase `json:"-" bson:"-"`
+		ID           bson.ObjectId          `bson:"_id"`
+		Name         string                 `bson:"name" validate:"required,min=2,max=10"`
+		Role         string                 `bson:"role" validate:"enum=admin|user"`
+		Age          *int                   `bson:"age" validate:"min=18"`
+		Score        float64                `bson:"score" validate:"max=100"`
+		Count        int64                  `bson:"count"`
+		Tags         []string               `bson:"tags" validate:"len=2,dive,regex=^[a-z]+$"`
+		Data         []byte                 `bson:"data"`
+		Meta         map[string]interface{} `bson:"meta"`
+		Address      schemaTestAddress      `bson:"address"`
+		Any          interface{}            `bson:"any"`
+		CreatedAt    time.Time              `bson:"createdAt"`
+		Ignored      string                 `bson:"-"`
+	}
+)
+
+func TestDocumentStructSchema(t *testing.T) {
+	documentStruct, err := DocumentStructParse(reflect.TypeOf(&schemaTestDocument{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := DocumentStructSchema(documentStruct)
+	if schema["bsonType"] != "object" {
+		t.Errorf("bsonType = %v", schema["bsonType"])
+	}
+	if required := schema["required"]; !reflect.DeepEqual(required, []string{"_id", "name"}) {
+		t.Errorf("required = %v", required)
+	}
+	properties := schema["properties"].(bson.M)
+	if _, ok := properties["Ignored"]; ok {
+		t.Errorf("ignored field in properties")
+	}
+
+	tests := []struct {
+		name string
+		want bson.M
+	}{
+		{name: "_id", want: bson.M{"bsonType": "objectId"}},
+		{name: "name", want: bson.M{"bsonType": "string", "minLength": 2, "maxLength": 10}},
+		{name: "role", want: bson.M{"bsonType": "string", "enum": []string{"admin", "user"}}},
+		{name: "age", want: bson.M{"bsonType": []string{"int", "long", "null"}, "minimum": float64(18)}},
+		{name: "score", want: bson.M{"bsonType": "double", "maximum": float64(100)}},
+		{name: "count", want: bson.M{"bsonType": "long"}},
+		{name: "tags", want: bson.M{"bsonType": []string{"array", "null"}, "minItems": 2, "maxItems": 2, "items": bson.M{"bsonType": "string", "pattern": "^[a-z]+$"}}},
+		{name: "data", want: bson.M{"bsonType": "binData"}},
+		{name: "meta", want: bson.M{"bsonType": []string{"object", "null"}}},
+		{name: "address", want: bson.M{"bsonType": "object", "required": []string{"city"}, "properties": bson.M{"city": bson.M{"bsonType": "string", "maxLength": 20}}}},
+		{name: "any", want: bson.M{}},
+		{name: "createdAt", want: bson.M{"bsonType": "date"}},
+	}
+	for _, test := range tests {
+		if got := properties[test.name]; !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: schema = %#v, want %#v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestModelCollectionValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		options ModelCollection
+		err     bool
+	}{
+		{name: "empty"},
+		{name: "capped", options: ModelCollection{Capped: true, MaxBytes: 1024}},
+		{name: "capped without size", options: ModelCollection{Capped: true}, err: true},
+		{name: "time series", options: ModelCollection{TimeSeries: &ModelTimeSeries{TimeField: "at"}, ExpireAfter: time.Hour}},
+		{name: "expire without time series", options: ModelCollection{ExpireAfter: time.Hour}, err: true},
+	}
+	for _, test := range tests {
+		if err := test.options.validate(); (err != nil) != test.err {
+			t.Errorf("%s: err = %v", test.name, err)
+		}
+	}
+}
+
+func TestCollectionDrift(t *testing.T) {
+	server := &mgo.Collation{Locale: "en", CaseFirst: "off", Strength: 3, Alternate: "non-ignorable", MaxVariable: "punct"}
+	tests := []struct {
+		name       string
+		collection ModelCollection
+		options    collectionOptions
+		drift      []string
+	}{
+		{name: "empty"},
+		{name: "collation defaults", collection: ModelCollection{Collation: &mgo.Collation{Locale: "en"}}, options: collectionOptions{Collation: server}},
+		{name: "collation strength", collection: ModelCollection{Collation: &mgo.Collation{Locale: "en", Strength: 2}}, options: collectionOptions{Collation: server}, drift: []string{"drift.collation"}},
+		{name: "collation case level", collection: ModelCollection{Collation: &mgo.Collation{Locale: "en", CaseLevel: true}}, options: collectionOptions{Collation: server}, drift: []string{"drift.collation"}},
+		{name: "collation removed", options: collectionOptions{Collation: server}, drift: []string{"drift.collation"}},
+		{name: "capped size", collection: ModelCollection{Capped: true, MaxBytes: 1000}, options: collectionOptions{Capped: true, Size: 1024}},
+		{name: "capped", collection: ModelCollection{Capped: true, MaxBytes: 1000}, drift: []string{"drift.capped"}},
+		{name: "view", collection: ModelCollection{ViewOn: "users"}, drift: []string{"drift.view"}},
+	}
+	for _, test := range tests {
+		if drift := collectionDrift(test.collection, test.options); !reflect.DeepEqual(drift, test.drift) {
+			t.Errorf("%s: drift = %v, want %v", test.name, drift, test.drift)
+		}
+	}
+}
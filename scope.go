@@ -0,0 +1,53 @@
+package model
+
+import (
+	"fmt"
+	"sort"
+)
+
+type (
+	ModelScopeFunc func(query *Query, args ...interface{}) *Query
+
+	// ModelScope 可复用的命名过滤条件
+	ModelScope struct {
+		Name        string         `json:"name"`
+		Description string         `json:"description,omitempty"`
+		Func        ModelScopeFunc `json:"-"`
+	}
+)
+
+func (model *Model) OnScope(name string, description string, fn ModelScopeFunc) {
+	if model.Scopes == nil {
+		model.Scopes = make(map[string]ModelScope, 0)
+	}
+	model.Scopes[name] = ModelScope{Name: name, Description: description, Func: fn}
+}
+
+func (model *Model) Scope(name string) (scope ModelScope, ok bool) {
+	scope, ok = model.Scopes[name]
+	return
+}
+
+// ScopeList 按名字排序
+func (model *Model) ScopeList() (scopes []ModelScope) {
+	for _, scope := range model.Scopes {
+		scopes = append(scopes, scope)
+	}
+	sort.Slice(scopes, func(i, j int) bool {
+		return scopes[i].Name < scopes[j].Name
+	})
+	return
+}
+
+// Scope 使用 model 注册的 scope 不存在的 记录错误 查询时返回
+func (query *Query) Scope(name string, args ...interface{}) *Query {
+	if query.err != nil {
+		return query
+	}
+	scope, ok := query.Model.Scope(name)
+	if !ok || scope.Func == nil {
+		query.err = fmt.Errorf("Query scope (%s) not found", name)
+		return query
+	}
+	return scope.Func(query, args...)
+}
@@ -0,0 +1,138 @@
+package model
+
+import (
+	"context"
+	"errors"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+type (
+	SessionOptions struct {
+		// primary, primaryPreferred, secondary, secondaryPreferred, nearest
+		ReadPreference string
+		Tags           []bson.D
+		// w, j, wtimeout
+		WriteConcern *mgo.Safe
+		// local, majority, linearizable, available
+		ReadConcern string
+	}
+
+	contextKey struct {
+		name string
+	}
+)
+
+var (
+	sessionContextKey        = &contextKey{"session"}
+	sessionOptionsContextKey = &contextKey{"sessionOptions"}
+
+	ErrNoSession = errors.New("mongo session not found in context")
+)
+
+func WithSession(ctx context.Context, session *mgo.Session) context.Context {
+	return context.WithValue(ctx, sessionContextKey, session)
+}
+
+// WithSessionCopy 复制 session 到 context 请求结束时调用 close
+func WithSessionCopy(ctx context.Context, session *mgo.Session) (context.Context, func()) {
+	session = session.Copy()
+	return WithSession(ctx, session), session.Close
+}
+
+// SessionFrom 从 context 中取 session 兼容 CONTEXT string key
+func SessionFrom(ctx context.Context) (session *mgo.Session, ok bool) {
+	if ctx == nil {
+		return
+	}
+	if session, ok = ctx.Value(sessionContextKey).(*mgo.Session); ok && session != nil {
+		return
+	}
+	session, ok = ctx.Value(CONTEXT).(*mgo.Session)
+	ok = ok && session != nil
+	return
+}
+
+var readPreferences = map[string]mgo.Mode{
+	"primary":            mgo.Primary,
+	"primaryPreferred":   mgo.PrimaryPreferred,
+	"secondary":          mgo.Secondary,
+	"secondaryPreferred": mgo.SecondaryPreferred,
+	"nearest":            mgo.Nearest,
+}
+
+// WithReadPreference 覆盖 model 的读偏好
+func WithReadPreference(ctx context.Context, readPreference string, tags ...bson.D) context.Context {
+	options := SessionOptionsFrom(ctx)
+	options.ReadPreference = readPreference
+	options.Tags = tags
+	return context.WithValue(ctx, sessionOptionsContextKey, options)
+}
+
+// WithWriteConcern 覆盖 model 的写关注
+func WithWriteConcern(ctx context.Context, safe *mgo.Safe) context.Context {
+	options := SessionOptionsFrom(ctx)
+	options.WriteConcern = safe
+	return context.WithValue(ctx, sessionOptionsContextKey, options)
+}
+
+// WithReadConcern 覆盖 model 的读关注
+func WithReadConcern(ctx context.Context, readConcern string) context.Context {
+	options := SessionOptionsFrom(ctx)
+	options.ReadConcern = readConcern
+	return context.WithValue(ctx, sessionOptionsContextKey, options)
+}
+
+// SessionOptionsFrom context 中覆盖的选项 ctx 为 nil 返回空的
+func SessionOptionsFrom(ctx context.Context) (options SessionOptions) {
+	if ctx == nil {
+		return
+	}
+	options, _ = ctx.Value(sessionOptionsContextKey).(SessionOptions)
+	return
+}
+
+// merge 不为空的 覆盖
+func (options SessionOptions) merge(value SessionOptions) SessionOptions {
+	if value.ReadPreference != "" {
+		options.ReadPreference = value.ReadPreference
+		options.Tags = value.Tags
+	}
+	if value.WriteConcern != nil {
+		options.WriteConcern = value.WriteConcern
+	}
+	if value.ReadConcern != "" {
+		options.ReadConcern = value.ReadConcern
+	}
+	return options
+}
+
+// apply 设置到 session 应该是克隆的 session
+func (options SessionOptions) apply(session *mgo.Session) {
+	if mode, ok := readPreferences[options.ReadPreference]; ok {
+		session.SetMode(mode, true)
+	}
+	if len(options.Tags) != 0 {
+		session.SelectServers(options.Tags...)
+	}
+	if options.WriteConcern != nil {
+		safe := *options.WriteConcern
+		if options.ReadConcern != "" {
+			safe.RMode = options.ReadConcern
+		}
+		session.SetSafe(&safe)
+	} else if options.ReadConcern != "" {
+		// 只有读关注 保留原来的写关注 原来不确认写入的 (nil) 设置读关注后恢复
+		current := session.Safe()
+		safe := mgo.Safe{RMode: options.ReadConcern}
+		if current != nil {
+			safe = *current
+			safe.RMode = options.ReadConcern
+		}
+		session.SetSafe(&safe)
+		if current == nil {
+			session.SetSafe(nil)
+		}
+	}
+}
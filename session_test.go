@@ -0,0 +1,31 @@
+package model
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/globalsign/mgo"
+)
+
+func TestSessionFromNil(t *testing.T) {
+	if session, ok := SessionFrom(nil); ok || session != nil {
+		t.Errorf("SessionFrom(nil) = %v, %v", session, ok)
+	}
+	if options := SessionOptionsFrom(nil); !reflect.DeepEqual(options, SessionOptions{}) {
+		t.Errorf("SessionOptionsFrom(nil) = %#v", options)
+	}
+}
+
+func TestSessionOptionsMerge(t *testing.T) {
+	safe := &mgo.Safe{W: 2}
+	ctx := WithReadConcern(WithWriteConcern(WithReadPreference(context.Background(), "secondary"), safe), "majority")
+	model := SessionOptions{ReadPreference: "primary", ReadConcern: "local"}
+	options := model.merge(SessionOptionsFrom(ctx))
+	if options.ReadPreference != "secondary" || options.WriteConcern != safe || options.ReadConcern != "majority" {
+		t.Errorf("merge = %#v", options)
+	}
+	if options := model.merge(SessionOptions{}); !reflect.DeepEqual(options, model) {
+		t.Errorf("merge empty = %#v", options)
+	}
+}
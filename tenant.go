@@ -0,0 +1,95 @@
+package model
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+type (
+	// TenantResolver 根据 context 返回租户的 数据库名 和 集合名
+	TenantResolver func(ctx context.Context, database, collection string) (string, string, error)
+)
+
+var tenantContextKey = &contextKey{"tenant"}
+
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantContextKey, tenant)
+}
+
+func TenantFrom(ctx context.Context) (tenant string, ok bool) {
+	if ctx == nil {
+		return
+	}
+	tenant, ok = ctx.Value(tenantContextKey).(string)
+	ok = ok && tenant != ""
+	return
+}
+
+// TenantDatabase 每个租户一个数据库 数据库名为租户名
+func TenantDatabase(ctx context.Context, database, collection string) (string, string, error) {
+	tenant, ok := TenantFrom(ctx)
+	if !ok {
+		return "", "", fmt.Errorf("Tenant not found in context (%s.%s)", database, collection)
+	}
+	return tenant, collection, nil
+}
+
+// TenantPrefix 每个租户一个集合前缀 <tenant>_<collection>
+func TenantPrefix(ctx context.Context, database, collection string) (string, string, error) {
+	tenant, ok := TenantFrom(ctx)
+	if !ok {
+		return "", "", fmt.Errorf("Tenant not found in context (%s.%s)", database, collection)
+	}
+	return database, tenant + "_" + collection, nil
+}
+
+// tenantNames 租户的 数据库名 和 集合名
+func (model *Model) tenantNames(ctx context.Context) (database string, collection string, err error) {
+	database, collection = model.names()
+	if model.Tenant != nil {
+		database, collection, err = model.Tenant(ctx, database, collection)
+	}
+	return
+}
+
+// SyncTenants 每个租户 创建集合 同步 index 失败的租户 不影响其他租户
+func (model *Model) SyncTenants(ctx context.Context, tenants []string) (results map[string][]string, err error) {
+	results = map[string][]string{}
+	var messages []string
+	for _, tenant := range tenants {
+		tenantCtx := WithTenant(ctx, tenant)
+		// 新建的 create 中已经 Update
+		created, updated, e := model.create(tenantCtx)
+		if e == nil && !created {
+			updated, e = model.Update(tenantCtx)
+		}
+		results[tenant] = updated
+		if e != nil {
+			messages = append(messages, tenant+": "+e.Error())
+		}
+	}
+	if len(messages) != 0 {
+		sort.Strings(messages)
+		err = fmt.Errorf("Model sync tenants %s", strings.Join(messages, "; "))
+	}
+	return
+}
+
+// SyncTenants 每个租户 SyncAll
+func (registry *Registry) SyncTenants(ctx context.Context, tenants []string) (results map[string][]RegistrySync, err error) {
+	results = map[string][]RegistrySync{}
+	var messages []string
+	for _, tenant := range tenants {
+		var e error
+		if results[tenant], e = registry.SyncAll(WithTenant(ctx, tenant)); e != nil {
+			messages = append(messages, tenant+": "+e.Error())
+		}
+	}
+	if len(messages) != 0 {
+		sort.Strings(messages)
+		err = fmt.Errorf("Registry sync tenants %s", strings.Join(messages, "; "))
+	}
+	return
+}
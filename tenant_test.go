@@ -0,0 +1,31 @@
+package model
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestTenantFrom(t *testing.T) {
+	if _, ok := TenantFrom(nil); ok {
+		t.Errorf("nil context has tenant")
+	}
+	if _, ok := TenantFrom(WithTenant(context.Background(), "")); ok {
+		t.Errorf("empty tenant")
+	}
+	if tenant, ok := TenantFrom(WithTenant(context.Background(), "a")); !ok || tenant != "a" {
+		t.Errorf("tenant = %s", tenant)
+	}
+}
+
+func TestModelSyncTenants(t *testing.T) {
+	// 没有 session 每个租户都失败 都返回
+	model := &Model{Name: "users", Tenant: TenantDatabase}
+	results, err := model.SyncTenants(context.Background(), []string{"b", "a"})
+	if err == nil || !strings.Contains(err.Error(), "a: ") || !strings.Contains(err.Error(), "b: ") {
+		t.Errorf("err = %v", err)
+	}
+	if _, ok := results["b"]; !ok || len(results) != 2 {
+		t.Errorf("results = %v", results)
+	}
+}
@@ -1,9 +1,424 @@
 package model
 
+import (
+	"fmt"
+	"net/mail"
+	"net/url"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/globalsign/mgo/bson"
+)
+
 type (
 	ValidatorInterface interface {
 		ValidateDocument(document DocumentInterface) (err error)
 	}
+
+	ValidateRule struct {
+		Name   string
+		Param  string
+		Regexp *regexp.Regexp
+	}
+
+	ValidationError struct {
+		Path  string `json:"path"`
+		Rule  string `json:"rule"`
+		Param string `json:"param,omitempty"`
+	}
+
+	ValidationErrors []ValidationError
+
+	// TagValidator 根据 validate 标签验证
+	// validate:"required,min=1,max=10,len=5,enum=a|b,email,url,dive,regex=^[a-z]+$"
+	// dive 之后的规则验证切片的每个元素 regex 必须是最后一个
+	TagValidator struct{}
 )
 
 var Validator ValidatorInterface
+
+func ValidateRuleParse(tag string) (rules []ValidateRule, err error) {
+	for tag != "" {
+		var item string
+		if strings.HasPrefix(tag, "regex=") {
+			item, tag = tag, ""
+		} else if i := strings.Index(tag, ","); i != -1 {
+			item, tag = tag[:i], tag[i+1:]
+		} else {
+			item, tag = tag, ""
+		}
+		if item == "" {
+			continue
+		}
+		rule := ValidateRule{Name: item}
+		if i := strings.Index(item, "="); i != -1 {
+			rule.Name, rule.Param = item[:i], item[i+1:]
+		}
+		switch rule.Name {
+		case "required", "email", "url", "dive":
+		case "min", "max", "len":
+			if _, err = strconv.ParseFloat(rule.Param, 64); err != nil {
+				err = fmt.Errorf("validate %s=%s invalid", rule.Name, rule.Param)
+				return
+			}
+		case "enum":
+		case "regex":
+			if rule.Regexp, err = regexp.Compile(rule.Param); err != nil {
+				return
+			}
+		default:
+			err = fmt.Errorf("validate %s unknown", rule.Name)
+			return
+		}
+		rules = append(rules, rule)
+	}
+	return
+}
+
+func (validationErrors ValidationErrors) Error() string {
+	var messages []string
+	for _, validationError := range validationErrors {
+		messages = append(messages, validationError.Error())
+	}
+	return strings.Join(messages, "; ")
+}
+
+func (validationError ValidationError) Error() string {
+	if validationError.Param != "" {
+		return fmt.Sprintf("%s: %s=%s", validationError.Path, validationError.Rule, validationError.Param)
+	}
+	return fmt.Sprintf("%s: %s", validationError.Path, validationError.Rule)
+}
+
+func (validator *TagValidator) ValidateDocument(document DocumentInterface) (err error) {
+	value := reflect.Indirect(reflect.ValueOf(document))
+	var documentStruct DocumentStruct
+	if documentStruct, err = DocumentStructParse(value.Type()); err != nil {
+		return
+	}
+	var validationErrors ValidationErrors
+	validateStruct(&validationErrors, nil, documentStruct, value)
+	if len(validationErrors) != 0 {
+		err = validationErrors
+	}
+	return
+}
+
+func validateStruct(validationErrors *ValidationErrors, base []string, documentStruct DocumentStruct, value reflect.Value) {
+	// 按字段顺序
+	fields := make([]DocumentStructField, 0, len(documentStruct))
+	for _, fieldStruct := range documentStruct {
+		fields = append(fields, fieldStruct)
+	}
+	sort.Slice(fields, func(i, j int) bool {
+		return fields[i].Index < fields[j].Index
+	})
+
+	for _, fieldStruct := range fields {
+		name := fieldStruct.BSON
+		if name == "" {
+			name = fieldStruct.JSON
+		}
+		if name == "" {
+			continue
+		}
+		path := append(append([]string{}, base...), name)
+		field := value.Field(fieldStruct.Index)
+		validateField(validationErrors, path, fieldStruct.Validate, field)
+
+		// 嵌套
+		if fieldStruct.Children == nil {
+			continue
+		}
+		field = reflect.Indirect(field)
+		switch field.Kind() {
+		case reflect.Struct:
+			validateStruct(validationErrors, path, fieldStruct.Children, field)
+		case reflect.Slice:
+			for i := 0; i < field.Len(); i++ {
+				if elem := reflect.Indirect(field.Index(i)); elem.Kind() == reflect.Struct {
+					validateStruct(validationErrors, append(path, strconv.Itoa(i)), fieldStruct.Children, elem)
+				}
+			}
+		}
+	}
+}
+
+func validateField(validationErrors *ValidationErrors, path []string, rules []ValidateRule, value reflect.Value) {
+	// nil 指针 没有的值 只验证 required 零值 验证所有规则
+	for value.IsValid() && (value.Kind() == reflect.Ptr || value.Kind() == reflect.Interface) && !value.IsNil() {
+		value = value.Elem()
+	}
+	absent := !value.IsValid() || ((value.Kind() == reflect.Ptr || value.Kind() == reflect.Interface) && value.IsNil())
+	for i, rule := range rules {
+		if absent {
+			if rule.Name == "required" {
+				*validationErrors = append(*validationErrors, ValidationError{Path: strings.Join(path, "."), Rule: rule.Name})
+			}
+			return
+		}
+		if rule.Name == "dive" {
+			if value.Kind() == reflect.Slice || value.Kind() == reflect.Array {
+				for j := 0; j < value.Len(); j++ {
+					validateField(validationErrors, append(append([]string{}, path...), strconv.Itoa(j)), rules[i+1:], value.Index(j))
+				}
+			}
+			return
+		}
+		if !validateRule(rule, value) {
+			*validationErrors = append(*validationErrors, ValidationError{Path: strings.Join(path, "."), Rule: rule.Name, Param: rule.Param})
+		}
+	}
+}
+
+func validateRule(rule ValidateRule, value reflect.Value) bool {
+	switch rule.Name {
+	case "required":
+		return !reflectValueZero(value)
+	case "min", "max", "len":
+		param, _ := strconv.ParseFloat(rule.Param, 64)
+		var n float64
+		switch value.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			n = float64(value.Int())
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			n = float64(value.Uint())
+		case reflect.Float32, reflect.Float64:
+			n = value.Float()
+		case reflect.String:
+			n = float64(len([]rune(value.String())))
+		case reflect.Slice, reflect.Map, reflect.Array:
+			n = float64(value.Len())
+		default:
+			return false
+		}
+		switch rule.Name {
+		case "min":
+			return n >= param
+		case "max":
+			return n <= param
+		default:
+			return n == param
+		}
+	case "enum":
+		str := fmt.Sprint(value.Interface())
+		for _, item := range strings.Split(rule.Param, "|") {
+			if item == str {
+				return true
+			}
+		}
+		return false
+	case "regex":
+		return value.Kind() == reflect.String && rule.Regexp.MatchString(value.String())
+	case "email":
+		if value.Kind() != reflect.String {
+			return false
+		}
+		address, err := mail.ParseAddress(value.String())
+		return err == nil && address.Address == value.String()
+	case "url":
+		if value.Kind() != reflect.String {
+			return false
+		}
+		u, err := url.ParseRequestURI(value.String())
+		return err == nil && u.Scheme != "" && u.Host != ""
+	default:
+		return false
+	}
+}
+
+// ValidateUpdate 验证 update 文档 ($set, $inc, $push, $unset ...) 的字段类型和验证规则
+// 没有运算符的 是替换整个 document  没有 Document 的 model 不验证
+func (model *Model) ValidateUpdate(update interface{}) (err error) {
+	if model.Document == nil {
+		return
+	}
+	var data []byte
+	if data, err = bson.Marshal(update); err != nil {
+		return
+	}
+	var updateMap bson.M
+	if err = bson.Unmarshal(data, &updateMap); err != nil {
+		return
+	}
+
+	documentType := reflect.Indirect(reflect.ValueOf(model.Document)).Type()
+	documentStruct := model.DocumentStruct()
+
+	var validationErrors ValidationErrors
+	for operator, value := range updateMap {
+		// 替换
+		if !strings.HasPrefix(operator, "$") {
+			documentv := reflect.New(documentType)
+			if err = bson.Unmarshal(data, documentv.Interface()); err != nil {
+				return
+			}
+			return model.Validate(documentv.Interface().(DocumentInterface))
+		}
+
+		values, ok := value.(bson.M)
+		if !ok {
+			err = fmt.Errorf("update %s not document", operator)
+			return
+		}
+		for name, val := range values {
+			var fieldType reflect.Type
+			var fieldRules []ValidateRule
+			var fieldChildren DocumentStruct
+			if fieldType, fieldRules, fieldChildren, err = updatePath(documentType, documentStruct, strings.Split(name, ".")); err != nil {
+				return
+			}
+			path := strings.Split(name, ".")
+
+			switch operator {
+			case "$set", "$setOnInsert", "$min", "$max":
+				validateUpdateValue(&validationErrors, path, fieldType, fieldRules, fieldChildren, val)
+			case "$inc", "$mul":
+				if fieldType != nil {
+					kind := fieldType.Kind()
+					if kind == reflect.Ptr {
+						kind = fieldType.Elem().Kind()
+					}
+					switch kind {
+					case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Float32, reflect.Float64:
+					default:
+						validationErrors = append(validationErrors, ValidationError{Path: name, Rule: "type", Param: fieldType.String()})
+						continue
+					}
+				}
+				validateUpdateValue(&validationErrors, path, reflect.TypeOf(float64(0)), nil, nil, val)
+			case "$push", "$addToSet":
+				if fieldType != nil {
+					if fieldType.Kind() == reflect.Ptr {
+						fieldType = fieldType.Elem()
+					}
+					if fieldType.Kind() != reflect.Slice {
+						validationErrors = append(validationErrors, ValidationError{Path: name, Rule: "type", Param: fieldType.String()})
+						continue
+					}
+					fieldType = fieldType.Elem()
+				}
+				fieldRules = validateRuleDive(fieldRules)
+				elems := []interface{}{val}
+				if each, ok := val.(bson.M); ok {
+					if items, ok := each["$each"].([]interface{}); ok {
+						elems = items
+					}
+				}
+				for _, elem := range elems {
+					validateUpdateValue(&validationErrors, path, fieldType, fieldRules, fieldChildren, elem)
+				}
+			case "$unset":
+				for _, rule := range fieldRules {
+					if rule.Name == "required" {
+						validationErrors = append(validationErrors, ValidationError{Path: name, Rule: rule.Name})
+						break
+					}
+				}
+			case "$pull", "$pullAll", "$pop", "$rename", "$currentDate", "$bit":
+			default:
+				err = fmt.Errorf("update %s unknown", operator)
+				return
+			}
+		}
+	}
+	if len(validationErrors) != 0 {
+		err = validationErrors
+	}
+	return
+}
+
+// updatePath 根据 bson 路径 找字段类型 interface map 的 类型为 nil
+func updatePath(t reflect.Type, documentStruct DocumentStruct, path []string) (fieldType reflect.Type, rules []ValidateRule, children DocumentStruct, err error) {
+	fieldType = t
+	children = documentStruct
+	for _, name := range path {
+		if fieldType == nil {
+			return
+		}
+		if fieldType.Kind() == reflect.Ptr {
+			fieldType = fieldType.Elem()
+		}
+		switch fieldType.Kind() {
+		case reflect.Struct:
+			var fieldStruct *DocumentStructField
+			for _, val := range children {
+				if val.BSON == name {
+					val := val
+					fieldStruct = &val
+					break
+				}
+			}
+			if fieldStruct == nil {
+				err = fmt.Errorf("update path (%s) not found", strings.Join(path, "."))
+				return
+			}
+			fieldType = fieldStruct.Type
+			rules = fieldStruct.Validate
+			children = fieldStruct.Children
+		case reflect.Slice, reflect.Array:
+			if _, e := strconv.Atoi(name); e != nil && !strings.HasPrefix(name, "$") {
+				err = fmt.Errorf("update path (%s) not found", strings.Join(path, "."))
+				return
+			}
+			fieldType = fieldType.Elem()
+			rules = validateRuleDive(rules)
+		case reflect.Map:
+			fieldType = fieldType.Elem()
+			rules = nil
+			children = nil
+			if fieldType.Kind() == reflect.Interface {
+				fieldType = nil
+			}
+		case reflect.Interface:
+			fieldType = nil
+		default:
+			err = fmt.Errorf("update path (%s) not found", strings.Join(path, "."))
+			return
+		}
+	}
+	return
+}
+
+// validateRuleDive dive 之后的规则
+func validateRuleDive(rules []ValidateRule) []ValidateRule {
+	for i, rule := range rules {
+		if rule.Name == "dive" {
+			return rules[i+1:]
+		}
+	}
+	return nil
+}
+
+func validateUpdateValue(validationErrors *ValidationErrors, path []string, t reflect.Type, rules []ValidateRule, children DocumentStruct, value interface{}) {
+	if t == nil || t.Kind() == reflect.Interface {
+		return
+	}
+
+	// 通过 bson 转换到字段类型 转换失败的 类型不匹配
+	data, err := bson.Marshal(bson.M{"v": value})
+	if err != nil {
+		*validationErrors = append(*validationErrors, ValidationError{Path: strings.Join(path, "."), Rule: "type", Param: t.String()})
+		return
+	}
+	mapv := reflect.New(reflect.MapOf(reflect.TypeOf(""), t))
+	if err = bson.Unmarshal(data, mapv.Interface()); err != nil {
+		*validationErrors = append(*validationErrors, ValidationError{Path: strings.Join(path, "."), Rule: "type", Param: t.String()})
+		return
+	}
+	fieldv := mapv.Elem().MapIndex(reflect.ValueOf("v"))
+	if !fieldv.IsValid() {
+		*validationErrors = append(*validationErrors, ValidationError{Path: strings.Join(path, "."), Rule: "type", Param: t.String()})
+		return
+	}
+
+	validateField(validationErrors, path, rules, fieldv)
+	if children != nil {
+		if elem := reflect.Indirect(fieldv); elem.Kind() == reflect.Struct {
+			validateStruct(validationErrors, path, children, elem)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package model
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestValidateRuleParse(t *testing.T) {
+	tests := []struct {
+		tag   string
+		names []string
+		err   bool
+	}{
+		{tag: "", names: nil},
+		{tag: "required", names: []string{"required"}},
+		{tag: "required,min=1,max=10", names: []string{"required", "min", "max"}},
+		{tag: "enum=a|b,email,url", names: []string{"enum", "email", "url"}},
+		{tag: "dive,len=2", names: []string{"dive", "len"}},
+		{tag: "min=1,regex=^[a-z,]+$", names: []string{"min", "regex"}},
+		{tag: "min=x", err: true},
+		{tag: "regex=[", err: true},
+		{tag: "unknown", err: true},
+	}
+	for _, test := range tests {
+		rules, err := ValidateRuleParse(test.tag)
+		if (err != nil) != test.err {
+			t.Errorf("%q: err = %v", test.tag, err)
+			continue
+		}
+		var names []string
+		for _, rule := range rules {
+			names = append(names, rule.Name)
+		}
+		if !test.err && !reflect.DeepEqual(names, test.names) {
+			t.Errorf("%q: rules = %v, want %v", test.tag, names, test.names)
+		}
+	}
+
+	rules, _ := ValidateRuleParse("regex=^[a-z,]+$")
+	if rules[0].Param != "^[a-z,]+$" || !rules[0].Regexp.MatchString("a,b") {
+		t.Errorf("regex param = %q", rules[0].Param)
+	}
+}
+
+func TestValidateField(t *testing.T) {
+	age := 20
+	zero := 0
+	var nilInt *int
+	tests := []struct {
+		tag    string
+		value  interface{}
+		errors []string
+	}{
+		{tag: "required", value: "a"},
+		{tag: "required", value: "", errors: []string{"required"}},
+		{tag: "required", value: nilInt, errors: []string{"required"}},
+		{tag: "min=18", value: 0, errors: []string{"min"}},
+		{tag: "min=18", value: 18},
+		{tag: "min=18", value: &age},
+		{tag: "min=18", value: &zero, errors: []string{"min"}},
+		{tag: "min=18", value: nilInt},
+		{tag: "max=3", value: "abcd", errors: []string{"max"}},
+		{tag: "len=2", value: []int{1, 2}},
+		{tag: "len=2", value: []int(nil), errors: []string{"len"}},
+		{tag: "enum=admin|user", value: "", errors: []string{"enum"}},
+		{tag: "enum=admin|user", value: "user"},
+		{tag: "email", value: "a@b.c"},
+		{tag: "email", value: "a", errors: []string{"email"}},
+		{tag: "url", value: "http://a.b/c"},
+		{tag: "url", value: "/c", errors: []string{"url"}},
+		{tag: "regex=^[a-z]+$", value: "", errors: []string{"regex"}},
+		{tag: "regex=^[a-z]+$", value: "abc"},
+		{tag: "dive,min=2", value: []int{1, 2, 0}, errors: []string{"min", "min"}},
+		{tag: "min=1,max=2", value: 3, errors: []string{"max"}},
+	}
+	for _, test := range tests {
+		rules, err := ValidateRuleParse(test.tag)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var validationErrors ValidationErrors
+		validateField(&validationErrors, []string{"f"}, rules, reflect.ValueOf(test.value))
+		var names []string
+		for _, validationError := range validationErrors {
+			names = append(names, validationError.Rule)
+		}
+		if !reflect.DeepEqual(names, test.errors) {
+			t.Errorf("%q %#v: errors = %v, want %v", test.tag, test.value, names, test.errors)
+		}
+	}
+}